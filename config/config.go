@@ -1,9 +1,51 @@
 package config
 
-import "github.com/yzzyx/mr/imap"
+import (
+	"gopkg.in/yaml.v2"
+)
 
 // Config describes the available configuration layout
 type Config struct {
 	Maildir   string
-	Mailboxes map[string]imap.Mailbox
+	Mailboxes map[string]Account
+}
+
+// Account describes a single account in the configuration.
+// The available settings depend on the type of the account, which defaults to "imap".
+type Account struct {
+	Type string
+
+	// All settings of the account, decoded by Decode
+	settings yaml.MapSlice
+}
+
+// UnmarshalYAML reads the type of the account, and keeps the other settings for Decode
+func (a *Account) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	err := unmarshal(&a.settings)
+	if err != nil {
+		return err
+	}
+
+	var common struct {
+		Type string
+	}
+	err = unmarshal(&common)
+	if err != nil {
+		return err
+	}
+
+	a.Type = common.Type
+	if a.Type == "" {
+		a.Type = "imap"
+	}
+	return nil
+}
+
+// Decode reads the settings of the account into v, which is a type specific configuration struct
+func (a *Account) Decode(v interface{}) error {
+	data, err := yaml.Marshal(a.settings)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, v)
 }
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// HomeDir returns the home directory of the current user
+func HomeDir() string {
+	if runtime.GOOS == "windows" {
+		home := os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
+		if home == "" {
+			home = os.Getenv("USERPROFILE")
+		}
+		return home
+	}
+	return os.Getenv("HOME")
+}
+
+// ExpandPath expands ~/, $HOME and other environment variables at the start of a path
+// from the configuration, and returns it as an absolute path
+func ExpandPath(inPath string) string {
+	if strings.HasPrefix(inPath, "$HOME") {
+		inPath = HomeDir() + inPath[5:]
+	} else if strings.HasPrefix(inPath, "~/") {
+		inPath = HomeDir() + inPath[1:]
+	}
+
+	if strings.HasPrefix(inPath, "$") {
+		end := strings.Index(inPath, string(os.PathSeparator))
+		inPath = os.Getenv(inPath[1:end]) + inPath[end:]
+	}
+	if filepath.IsAbs(inPath) {
+		return filepath.Clean(inPath)
+	}
+
+	p, err := filepath.Abs(inPath)
+	if err == nil {
+		return filepath.Clean(p)
+	}
+	return ""
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/yzzyx/mr/config"
+	"github.com/yzzyx/mr/notmuch"
+)
+
+// dedupeMessages implements "mr dedupe [--remove [--force]] [query]", which reports messages that
+// are stored in several files with identical contents. With --remove, all but one of the
+// identical files are deleted and removed from the index. Deleting a file in the maildir of an
+// IMAP or JMAP account also removes that copy from the server, so those files are only
+// deleted if --force is given.
+func dedupeMessages(db *notmuch.Database, cfg config.Config, maildirPath string, args []string) error {
+	fs := flag.NewFlagSet("dedupe", flag.ContinueOnError)
+	remove := fs.Bool("remove", false, "delete all but one of the identical files")
+	force := fs.Bool("force", false, "also delete files in the folders of IMAP and JMAP accounts")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 || (*force && !*remove) {
+		return errors.New("usage: mr dedupe [--remove [--force]] [query]")
+	}
+	if *force {
+		fmt.Fprintln(os.Stderr, "warning: files deleted in the folders of IMAP and JMAP accounts are also deleted on the servers")
+	}
+	synced := func(filename string) bool {
+		return syncedAccount(cfg, maildirPath, filename) != ""
+	}
+	query := "*"
+	if len(positional) == 1 {
+		query = positional[0]
+	}
+
+	type message struct {
+		id        string
+		filenames []string
+	}
+	var messages []message
+
+	db.Lock()
+	q := db.CreateQuery(query)
+	it := q.SearchMessages()
+	for it.Valid() {
+		m := it.Get()
+		msg := message{id: m.GetMessageId()}
+		filenames := m.GetFileNames()
+		for filenames.Valid() {
+			msg.filenames = append(msg.filenames, filenames.Get())
+			filenames.MoveToNext()
+		}
+		filenames.Destroy()
+		if len(msg.filenames) > 1 {
+			messages = append(messages, msg)
+		}
+		it.MoveToNext()
+	}
+	it.Destroy()
+	q.Destroy()
+	db.Unlock()
+
+	duplicates, removed, skipped := 0, 0, 0
+	for _, msg := range messages {
+		groups, errs := duplicateGroups(msg.filenames)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", msg.id, err)
+		}
+
+		for _, files := range groups {
+			duplicates += len(files) - 1
+			fmt.Printf("%s: %d identical copies\n", msg.id, len(files))
+			if !*remove {
+				fmt.Printf("  keeping %s\n", files[0])
+				for _, filename := range files[1:] {
+					fmt.Printf("  duplicate %s\n", filename)
+				}
+				continue
+			}
+
+			keep, del, skip := planRemoval(files, synced, *force)
+			fmt.Printf("  keeping %s\n", keep)
+			for _, filename := range skip {
+				fmt.Printf("  skipping %s, which belongs to a synchronized account (use --force to delete it)\n", filename)
+				skipped++
+			}
+			for _, filename := range del {
+				err = removeDuplicate(db, filename)
+				if err != nil {
+					return fmt.Errorf("cannot remove %s: %s", filename, err)
+				}
+				fmt.Printf("  removed %s\n", filename)
+				removed++
+			}
+		}
+	}
+
+	fmt.Printf("found %d duplicate files", duplicates)
+	if *remove {
+		fmt.Printf(", removed %d", removed)
+		if skipped > 0 {
+			fmt.Printf(", skipped %d in synchronized accounts", skipped)
+		}
+	}
+	fmt.Println()
+	return nil
+}
+
+// duplicateGroups groups the files of a message by their contents. Only groups of more than one
+// file are returned, sorted by name and in order of the first file of each group.
+// Files which can't be read are left out, and the errors are returned.
+func duplicateGroups(filenames []string) ([][]string, []error) {
+	filenames = append([]string(nil), filenames...)
+	sort.Strings(filenames)
+
+	var sums []string
+	var errs []error
+	groups := make(map[string][]string)
+	for _, filename := range filenames {
+		sum, err := fileChecksum(filename)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if groups[sum] == nil {
+			sums = append(sums, sum)
+		}
+		groups[sum] = append(groups[sum], filename)
+	}
+
+	var result [][]string
+	for _, sum := range sums {
+		if len(groups[sum]) > 1 {
+			result = append(result, groups[sum])
+		}
+	}
+	return result, errs
+}
+
+// planRemoval decides which file of a group of identical files is kept, and which ones are deleted.
+// Unless force is set, files for which synced returns true are skipped instead of deleted, and
+// one of them is kept, so that the local copies are the ones that are deleted.
+func planRemoval(files []string, synced func(filename string) bool, force bool) (keep string, remove []string, skip []string) {
+	keepIdx := 0
+	if !force {
+		for k, filename := range files {
+			if synced(filename) {
+				keepIdx = k
+				break
+			}
+		}
+	}
+
+	keep = files[keepIdx]
+	for k, filename := range files {
+		switch {
+		case k == keepIdx:
+		case !force && synced(filename):
+			skip = append(skip, filename)
+		default:
+			remove = append(remove, filename)
+		}
+	}
+	return keep, remove, skip
+}
+
+// syncedTypes are the types of accounts whose local changes are pushed to a server.
+// Local maildir accounts only index their files, and POP3 accounts only download messages.
+var syncedTypes = map[string]bool{"imap": true, "jmap": true}
+
+// syncedAccount returns the name of the synchronized account whose folder in the maildir contains
+// a file, or an empty string if it's not stored in the folder of a synchronized account
+func syncedAccount(cfg config.Config, maildirPath string, filename string) string {
+	for name, account := range cfg.Mailboxes {
+		if !syncedTypes[account.Type] {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Join(maildirPath, name), filename)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return name
+		}
+	}
+	return ""
+}
+
+// fileChecksum returns the SHA-256 checksum of the contents of a file
+func fileChecksum(filename string) (string, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, fd)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// removeDuplicate removes one of the files of a message from the index, and deletes it.
+// The message itself stays in the index, since there are other files containing it.
+func removeDuplicate(db *notmuch.Database, filename string) error {
+	db.Lock()
+	st := db.RemoveMessage(filename)
+	db.Unlock()
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return errors.New(st.String())
+	}
+	return os.Remove(filename)
+}
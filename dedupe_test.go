@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yzzyx/mr/config"
+)
+
+func TestDuplicateGroups(t *testing.T) {
+	path, err := ioutil.TempDir("", "mr-dedupe-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	files := map[string]string{
+		"a": "first",
+		"b": "second",
+		"c": "first",
+		"d": "third",
+		"e": "second",
+		"f": "first",
+	}
+	var filenames []string
+	for name, contents := range files {
+		filename := filepath.Join(path, name)
+		err = ioutil.WriteFile(filename, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	filenames = append(filenames, filepath.Join(path, "missing"))
+
+	groups, errs := duplicateGroups(filenames)
+	expected := [][]string{
+		{filepath.Join(path, "a"), filepath.Join(path, "c"), filepath.Join(path, "f")},
+		{filepath.Join(path, "b"), filepath.Join(path, "e")},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %v, got %v", expected, groups)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected one error for the missing file, got %v", errs)
+	}
+}
+
+func TestPlanRemoval(t *testing.T) {
+	cfg := config.Config{Mailboxes: map[string]config.Account{
+		"work":     {Type: "imap"},
+		"import":   {Type: "maildir"},
+		"home":     {Type: "pop3"},
+		"fastmail": {Type: "jmap"},
+	}}
+	synced := func(filename string) bool {
+		return syncedAccount(cfg, "/mail", filename) != ""
+	}
+
+	tests := []struct {
+		files  []string
+		force  bool
+		keep   string
+		remove []string
+		skip   []string
+	}{
+		{
+			files:  []string{"/mail/import/cur/a", "/mail/import/cur/b"},
+			keep:   "/mail/import/cur/a",
+			remove: []string{"/mail/import/cur/b"},
+		},
+		{
+			// A copy in a synchronized account is kept instead of a local one
+			files:  []string{"/mail/import/cur/a", "/mail/work/INBOX/cur/b"},
+			keep:   "/mail/work/INBOX/cur/b",
+			remove: []string{"/mail/import/cur/a"},
+		},
+		{
+			files: []string{"/mail/work/INBOX/cur/a", "/mail/work/Archive/cur/b", "/mail/workshop/cur/c"},
+			keep:  "/mail/work/INBOX/cur/a",
+			skip:  []string{"/mail/work/Archive/cur/b"},
+			// Not in the folder of the work account
+			remove: []string{"/mail/workshop/cur/c"},
+		},
+		{
+			// Files in maildir and POP3 accounts aren't on a server
+			files:  []string{"/mail/import/cur/a", "/mail/home/INBOX/cur/b", "/mail/fastmail/Inbox/cur/c"},
+			keep:   "/mail/fastmail/Inbox/cur/c",
+			remove: []string{"/mail/import/cur/a", "/mail/home/INBOX/cur/b"},
+		},
+		{
+			files: []string{"/mail/fastmail/Inbox/cur/a", "/mail/fastmail/Archive/cur/b"},
+			keep:  "/mail/fastmail/Inbox/cur/a",
+			skip:  []string{"/mail/fastmail/Archive/cur/b"},
+		},
+		{
+			files:  []string{"/mail/work/INBOX/cur/a", "/mail/work/Archive/cur/b"},
+			force:  true,
+			keep:   "/mail/work/INBOX/cur/a",
+			remove: []string{"/mail/work/Archive/cur/b"},
+		},
+	}
+
+	for _, test := range tests {
+		keep, remove, skip := planRemoval(test.files, synced, test.force)
+		if keep != test.keep {
+			t.Errorf("%v: expected to keep %s, got %s", test.files, test.keep, keep)
+		}
+		if !reflect.DeepEqual(remove, test.remove) {
+			t.Errorf("%v: expected to remove %v, got %v", test.files, test.remove, remove)
+		}
+		if !reflect.DeepEqual(skip, test.skip) {
+			t.Errorf("%v: expected to skip %v, got %v", test.files, test.skip, skip)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/yzzyx/mr/oauth2"
+	"github.com/yzzyx/mr/source"
+)
+
+// Supported values of Mailbox.Auth
+const (
+	authPlain       = "plain"
+	authXOAuth2     = "xoauth2"
+	authOAuthBearer = "oauthbearer"
+)
+
+// authMethod returns the configured authentication method, which defaults to plain LOGIN
+func (h *Handler) authMethod() (string, error) {
+	method := strings.ToLower(h.mailbox.Auth)
+	switch method {
+	case "", authPlain:
+		return authPlain, nil
+	case authXOAuth2, authOAuthBearer:
+		return method, nil
+	}
+	return "", fmt.Errorf("unknown authentication method %s", h.mailbox.Auth)
+}
+
+// checkCredentials makes sure that the credentials needed by the authentication method are configured
+func (h *Handler) checkCredentials() error {
+	method, err := h.authMethod()
+	if err != nil {
+		return err
+	}
+
+	if method == authPlain && h.mailbox.Password == "" && h.mailbox.PasswordCommand == "" && h.mailbox.PasswordFile == "" {
+		return errors.New("imap password not configured")
+	}
+	return nil
+}
+
+// password returns the password used for plain authentication, either from the configuration,
+// the output of PasswordCommand, or the contents of PasswordFile.
+// Passwords which are not configured directly are only read once.
+func (h *Handler) password() (string, error) {
+	if h.mailbox.Password != "" {
+		return h.mailbox.Password, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cachedPassword != "" {
+		return h.cachedPassword, nil
+	}
+
+	var password string
+	var err error
+	if h.mailbox.PasswordCommand != "" {
+		password, err = source.PasswordCommand(h.mailbox.PasswordCommand)
+	} else {
+		password, err = source.PasswordFile(h.mailbox.PasswordFile)
+	}
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("imap password is empty")
+	}
+
+	h.cachedPassword = password
+	return password, nil
+}
+
+// authenticate logs in to the server, using the configured authentication method
+func (h *Handler) authenticate(c *client.Client, port int) error {
+	method, err := h.authMethod()
+	if err != nil {
+		return err
+	}
+
+	if method == authPlain {
+		password, err := h.password()
+		if err != nil {
+			return err
+		}
+		return c.Login(h.mailbox.Username, password)
+	}
+
+	token, err := h.tokens.Token()
+	if err != nil {
+		return err
+	}
+
+	if method == authXOAuth2 {
+		return c.Authenticate(&oauth2.XOAuth2Client{
+			Username: h.mailbox.Username,
+			Token:    token,
+		})
+	}
+	return c.Authenticate(&oauth2.OAuthBearerClient{
+		Username: h.mailbox.Username,
+		Token:    token,
+		Host:     h.mailbox.Server,
+		Port:     port,
+	})
+}
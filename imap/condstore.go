@@ -0,0 +1,277 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// folderSync keeps track of a single synchronization pass of a folder
+type folderSync struct {
+	mailbox string
+	status  *imap.MailboxStatus
+
+	// Set if UIDVALIDITY has changed since the last pass
+	uidValidityChanged bool
+
+	// HIGHESTMODSEQ of the folder when it was selected, and after the last completed pass.
+	// Both are zero if the server doesn't support CONDSTORE (RFC 7162)
+	modSeq     uint64
+	lastModSeq uint64
+}
+
+// unchanged returns true if nothing has changed in the folder since the last pass
+func (fs *folderSync) unchanged() bool {
+	return fs.modSeq != 0 && fs.modSeq == fs.lastModSeq
+}
+
+// parseNumber64 parses a 64-bit number, such as a mod-sequence value
+func parseNumber64(f interface{}) (uint64, error) {
+	switch f := f.(type) {
+	case uint32:
+		return uint64(f), nil
+	case string:
+		return strconv.ParseUint(f, 10, 64)
+	case imap.RawString:
+		return strconv.ParseUint(string(f), 10, 64)
+	}
+	return 0, fmt.Errorf("invalid 64-bit number %v", f)
+}
+
+// parseVanished parses the fields of a VANISHED response (RFC 7162), and returns the UIDs it contains
+func parseVanished(fields []interface{}) (*imap.SeqSet, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("VANISHED response without UIDs")
+	}
+
+	// The UIDs are always the last field, after the optional (EARLIER) tag
+	switch uids := fields[len(fields)-1].(type) {
+	case string:
+		return imap.ParseSeqSet(uids)
+	case uint32:
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids)
+		return seqSet, nil
+	}
+	return nil, errors.New("invalid UIDs in VANISHED response")
+}
+
+// enableCommand is an ENABLE command, as defined in RFC 5161
+type enableCommand struct {
+	capabilities []string
+}
+
+func (cmd *enableCommand) Command() *imap.Command {
+	args := make([]interface{}, len(cmd.capabilities))
+	for i, capability := range cmd.capabilities {
+		args[i] = imap.RawString(capability)
+	}
+	return &imap.Command{Name: "ENABLE", Arguments: args}
+}
+
+// enableQResync enables QRESYNC on a connection, if the server supports it.
+// This has to be done before a mailbox is selected.
+func enableQResync(c *client.Client) error {
+	qresync, err := c.Support("QRESYNC")
+	if err != nil || !qresync {
+		return err
+	}
+
+	status, err := c.Execute(&enableCommand{capabilities: []string{"QRESYNC"}}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// selectCommand is a SELECT command with the CONDSTORE parameter
+type selectCommand struct {
+	commands.Select
+}
+
+func (cmd *selectCommand) Command() *imap.Command {
+	c := cmd.Select.Command()
+	c.Arguments = append(c.Arguments, []interface{}{imap.RawString("CONDSTORE")})
+	return c
+}
+
+// selectResponse is a SELECT response, which also keeps track of HIGHESTMODSEQ
+type selectResponse struct {
+	responses.Select
+	highestModSeq uint64
+}
+
+func (r *selectResponse) Handle(resp imap.Resp) error {
+	if status, ok := resp.(*imap.StatusResp); ok && status.Tag == "*" {
+		switch status.Code {
+		case "HIGHESTMODSEQ":
+			if len(status.Arguments) == 0 {
+				return errors.New("HIGHESTMODSEQ without value")
+			}
+			modSeq, err := parseNumber64(status.Arguments[0])
+			if err != nil {
+				return err
+			}
+			r.highestModSeq = modSeq
+			return nil
+		case "NOMODSEQ":
+			// The mailbox doesn't support mod-sequences, so highestModSeq is left at zero
+			return nil
+		}
+	}
+	return r.Select.Handle(resp)
+}
+
+// selectCondstore selects a mailbox with CONDSTORE enabled, and returns its status and HIGHESTMODSEQ
+func selectCondstore(c *client.Client, mailbox string) (*imap.MailboxStatus, uint64, error) {
+	mbox := &imap.MailboxStatus{Name: mailbox, Items: make(map[imap.StatusItem]interface{})}
+	res := &selectResponse{Select: responses.Select{Mailbox: mbox}}
+
+	// Make sure that unilateral responses (e.g. EXISTS) are applied to the new mailbox
+	c.SetState(c.State(), mbox)
+
+	status, err := c.Execute(&selectCommand{commands.Select{Mailbox: mailbox}}, res)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		c.SetState(imap.AuthenticatedState, nil)
+		return nil, 0, err
+	}
+
+	mbox.ReadOnly = status.Code == imap.CodeReadOnly
+	c.SetState(imap.SelectedState, mbox)
+	return mbox, res.highestModSeq, nil
+}
+
+// selectFolder selects a mailbox, and starts a new synchronization pass of it.
+// If the server supports CONDSTORE, the current HIGHESTMODSEQ is compared with
+// the one from the last pass, so that only changes have to be fetched.
+func (h *Handler) selectFolder(c *client.Client, mailbox string) (*folderSync, error) {
+	condstore, err := c.Support("CONDSTORE")
+	if err != nil {
+		return nil, err
+	}
+	if !condstore {
+		// QRESYNC implies CONDSTORE
+		condstore, err = c.Support("QRESYNC")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fs := &folderSync{mailbox: mailbox}
+	if condstore {
+		fs.status, fs.modSeq, err = selectCondstore(c, mailbox)
+	} else {
+		fs.status, err = c.Select(mailbox, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fs.uidValidityChanged = h.checkUIDValidity(mailbox, fs.status.UidValidity)
+	if fs.modSeq != 0 {
+		fs.lastModSeq = h.getHighestModSeq(mailbox)
+	}
+	return fs, nil
+}
+
+// fetchChangedCommand is a UID FETCH command with the CHANGEDSINCE modifier,
+// and optionally the VANISHED modifier if QRESYNC is enabled
+type fetchChangedCommand struct {
+	seqSet   *imap.SeqSet
+	items    []imap.FetchItem
+	modSeq   uint64
+	vanished bool
+}
+
+func (cmd *fetchChangedCommand) Command() *imap.Command {
+	c := (&commands.Uid{Cmd: &commands.Fetch{SeqSet: cmd.seqSet, Items: cmd.items}}).Command()
+
+	modifiers := []interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(cmd.modSeq, 10))}
+	if cmd.vanished {
+		modifiers = append(modifiers, imap.RawString("VANISHED"))
+	}
+	c.Arguments = append(c.Arguments, modifiers)
+	return c
+}
+
+// fetchChangedResponse is a FETCH response, which also collects the UIDs of VANISHED responses
+type fetchChangedResponse struct {
+	responses.Fetch
+	vanished *imap.SeqSet
+}
+
+func (r *fetchChangedResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if ok && name == "VANISHED" {
+		uids, err := parseVanished(fields)
+		if err != nil {
+			return err
+		}
+		r.vanished.AddSet(uids)
+		return nil
+	}
+	return r.Fetch.Handle(resp)
+}
+
+// uidFetchChanged works like uidFetch, but only fetches messages that have changed since modSeq.
+// If vanished is set, the UIDs of messages that have been expunged since modSeq are returned.
+func uidFetchChanged(c *client.Client, seqSet *imap.SeqSet, items []imap.FetchItem, modSeq uint64, vanished bool, fn func(msg *imap.Message) error) (*imap.SeqSet, error) {
+	messages := make(chan *imap.Message, 100)
+	res := &fetchChangedResponse{
+		Fetch:    responses.Fetch{Messages: messages},
+		vanished: new(imap.SeqSet),
+	}
+	cmd := &fetchChangedCommand{
+		seqSet:   seqSet,
+		items:    items,
+		modSeq:   modSeq,
+		vanished: vanished,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer close(messages)
+		status, err := c.Execute(cmd, res)
+		if err == nil {
+			err = status.Err()
+		}
+		done <- err
+	}()
+
+	var fnErr error
+	for msg := range messages {
+		// Keep reading until the channel is closed, otherwise the client would block
+		if fnErr == nil {
+			fnErr = fn(msg)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return res.vanished, fnErr
+}
+
+func (h *Handler) getHighestModSeq(mailbox string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cfg.HighestModSeq[mailbox]
+}
+
+func (h *Handler) setHighestModSeq(mailbox string, modSeq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if modSeq == 0 {
+		delete(h.cfg.HighestModSeq, mailbox)
+		return
+	}
+	h.cfg.HighestModSeq[mailbox] = modSeq
+}
@@ -0,0 +1,213 @@
+package imap
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Number of messages downloaded with a single UID FETCH command
+var fetchBatchSize = 100
+
+// fetchBatch is a set of messages downloaded with a single UID FETCH command per download mode
+type fetchBatch struct {
+	full    *imap.SeqSet
+	partial *imap.SeqSet
+	lastUID uint32 // Highest UID in the batch
+}
+
+// batchProgress advances the last seen UID of a mailbox as batches are stored.
+// Batches may be stored out of order when downloading over several connections,
+// so the UID only moves past a batch once all batches before it have been stored.
+type batchProgress struct {
+	h       *Handler
+	mailbox string
+	batches []*fetchBatch
+
+	mu     sync.Mutex
+	stored []bool
+	next   int // First batch which hasn't been stored
+}
+
+func newBatchProgress(h *Handler, mailbox string, batches []*fetchBatch) *batchProgress {
+	return &batchProgress{
+		h:       h,
+		mailbox: mailbox,
+		batches: batches,
+		stored:  make([]bool, len(batches)),
+	}
+}
+
+// batchStored marks batch i as stored, and saves the synchronization state
+func (p *batchProgress) batchStored(i int) {
+	p.mu.Lock()
+	p.stored[i] = true
+	for p.next < len(p.batches) && p.stored[p.next] {
+		p.h.setLastSeenUID(p.mailbox, p.batches[p.next].lastUID)
+		p.next++
+	}
+	p.mu.Unlock()
+
+	p.h.checkpoint()
+}
+
+// downloadMessages downloads the messages with the specified UIDs from the mailbox currently
+// selected on 'c', and stores them in the maildir. Only the headers are downloaded for the
+// messages listed in 'partial'. If Connections is set, the messages are downloaded in batches
+// over several connections in parallel.
+// The last seen UID of the mailbox is advanced and saved after each batch, so that
+// messages which have been stored aren't downloaded again if the download is interrupted.
+// If the handler is closed, the download stops after the current message, and errClosed is returned.
+func (h *Handler) downloadMessages(c *client.Client, mailbox string, uids []uint32, partial map[uint32]bool) error {
+	uids = append([]uint32(nil), uids...)
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	var batches []*fetchBatch
+	for len(uids) > 0 {
+		n := fetchBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+
+		batch := &fetchBatch{full: new(imap.SeqSet), partial: new(imap.SeqSet), lastUID: uids[n-1]}
+		for _, uid := range uids[:n] {
+			if partial[uid] {
+				batch.partial.AddNum(uid)
+			} else {
+				batch.full.AddNum(uid)
+			}
+		}
+		batches = append(batches, batch)
+		uids = uids[n:]
+	}
+	progress := newBatchProgress(h, mailbox, batches)
+
+	workers := h.mailbox.Connections
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+	if workers <= 1 {
+		for i, batch := range batches {
+			if h.closed() {
+				return errClosed
+			}
+			err := h.downloadBatch(c, mailbox, batch)
+			if err != nil {
+				return err
+			}
+			progress.batchStored(i)
+		}
+		return nil
+	}
+
+	// The first error stops all downloads
+	var firstErr error
+	var failOnce sync.Once
+	failed := make(chan struct{})
+	fail := func(err error) {
+		failOnce.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			wc := c
+			if i > 0 {
+				var err error
+				wc, err = h.connectMailbox(mailbox)
+				if err != nil {
+					// The remaining connections can still do the job
+					fmt.Fprintf(h.out, "could not open extra connection for %s: %s\n", mailbox, err)
+					return
+				}
+				defer wc.Logout()
+			}
+
+			for n := range queue {
+				err := h.downloadBatch(wc, mailbox, batches[n])
+				if err != nil {
+					fail(err)
+					return
+				}
+				progress.batchStored(n)
+			}
+		}(i)
+	}
+
+feed:
+	for n := range batches {
+		select {
+		case queue <- n:
+		case <-failed:
+			break feed
+		case <-h.done:
+			fail(errClosed)
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+// connectMailbox opens a new connection, and selects a mailbox in read-only mode
+func (h *Handler) connectMailbox(mailbox string) (*client.Client, error) {
+	c, err := h.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.Select(mailbox, true)
+	if err != nil {
+		_ = c.Logout()
+		return nil, err
+	}
+	return c, nil
+}
+
+// downloadBatch downloads a batch of messages from the selected mailbox, and stores them in the maildir
+func (h *Handler) downloadBatch(c *client.Client, mailbox string, batch *fetchBatch) error {
+	if !batch.full.Empty() {
+		err := h.fetchMessages(c, mailbox, batch.full, false)
+		if err != nil {
+			return err
+		}
+	}
+	if !batch.partial.Empty() {
+		return h.fetchMessages(c, mailbox, batch.partial, true)
+	}
+	return nil
+}
+
+// fetchMessages downloads a set of messages from the selected mailbox, and stores them in the maildir.
+// If headersOnly is set, only the headers of the messages are downloaded.
+func (h *Handler) fetchMessages(c *client.Client, mailbox string, seqSet *imap.SeqSet, headersOnly bool) error {
+	// Use BODY.PEEK[], so that the messages aren't marked as read on the server
+	section := &imap.BodySectionName{Peek: true}
+	if headersOnly {
+		section.Specifier = imap.HeaderSpecifier
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, section.FetchItem()}
+	items = append(items, h.gmailItems()...)
+
+	return uidFetch(c, seqSet, items, func(msg *imap.Message) error {
+		if h.closed() {
+			return errClosed
+		}
+		r := msg.GetBody(section)
+		if r == nil {
+			return fmt.Errorf("server didn't return body of message %d in %s", msg.Uid, mailbox)
+		}
+		return h.storeMessage(mailbox, msg, r, headersOnly)
+	})
+}
@@ -0,0 +1,214 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/yzzyx/mr/notmuch"
+)
+
+// localUIDs returns a map from UID to path for all messages stored locally in a mailbox
+func (h *Handler) localUIDs(mailbox string) (map[uint32]string, error) {
+	files, err := h.localMessageFiles(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[uint32]string, len(files))
+	for _, path := range files {
+		field := uidRegexp.FindString(filepath.Base(path))
+		if field == "" {
+			continue
+		}
+
+		uid, err := strconv.ParseUint(field[len(",U="):], 10, 32)
+		if err != nil {
+			continue
+		}
+		result[uint32(uid)] = path
+	}
+	return result, nil
+}
+
+// remoteUIDs returns the UIDs of all messages in the currently selected mailbox
+func remoteUIDs(c *client.Client) (map[uint32]bool, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = seqSet
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		result[uid] = true
+	}
+	return result, nil
+}
+
+// syncDeletions finds messages that have been removed from a mailbox on the server,
+// and removes them from the local maildir and the index.
+// If a removed message has been seen in another mailbox, it is assumed to have been moved there,
+// and the local file is moved instead.
+// This completes the synchronization pass started by selectFolder.
+func (h *Handler) syncDeletions(c *client.Client, fs *folderSync) error {
+	mailbox := fs.mailbox
+	_, err := c.Select(mailbox, true)
+	if err != nil {
+		return err
+	}
+
+	local, err := h.localUIDs(mailbox)
+	if err != nil {
+		return err
+	}
+
+	// With QRESYNC, the server can tell us which messages have been expunged since the last pass
+	qresync, err := c.Support("QRESYNC")
+	if err != nil {
+		return err
+	}
+
+	lastSeenUID := h.getLastSeenUID(mailbox)
+	switch {
+	case fs.unchanged() && qresync:
+		// Expunging messages changes HIGHESTMODSEQ, so nothing has been removed
+	case fs.lastModSeq != 0 && qresync && lastSeenUID > 0:
+		seqSet := new(imap.SeqSet)
+		seqSet.AddRange(1, lastSeenUID)
+		vanished, err := uidFetchChanged(c, seqSet, []imap.FetchItem{imap.FetchUid}, fs.lastModSeq, true, func(msg *imap.Message) error {
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = h.removeVanished(mailbox, local, vanished.Contains)
+		if err != nil {
+			return err
+		}
+	default:
+		remote, err := remoteUIDs(c)
+		if err != nil {
+			return err
+		}
+
+		err = h.removeVanished(mailbox, local, func(uid uint32) bool { return !remote[uid] })
+		if err != nil {
+			return err
+		}
+	}
+
+	h.setHighestModSeq(mailbox, fs.modSeq)
+	return nil
+}
+
+// removeVanished removes all messages in 'local' for which vanished returns true
+func (h *Handler) removeVanished(mailbox string, local map[uint32]string, vanished func(uid uint32) bool) error {
+	lastSeenUID := h.getLastSeenUID(mailbox)
+
+	for uid, path := range local {
+		// Messages we haven't checked on the server yet are left alone
+		if !vanished(uid) || uid > lastSeenUID {
+			continue
+		}
+
+		var messageID string
+		if state := h.getMessageState(mailbox, uid); state != nil {
+			messageID = state.MessageID
+		}
+
+		err := h.removeMessage(mailbox, uid, messageID, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Forget about removed messages that weren't stored in this mailbox
+	h.mu.Lock()
+	for uid := range h.cfg.Messages[mailbox] {
+		if vanished(uid) && uid <= lastSeenUID {
+			delete(h.cfg.Messages[mailbox], uid)
+		}
+	}
+	h.mu.Unlock()
+	return nil
+}
+
+// removeMessage removes a message that has been expunged on the server, or moves it
+// to the mailbox it was moved to on the server, if we've seen it there.
+func (h *Handler) removeMessage(mailbox string, uid uint32, messageID string, path string) error {
+	h.db.Lock()
+	defer h.db.Unlock()
+
+	h.deleteMessageState(mailbox, uid)
+
+	if messageID != "" {
+		target, targetUID, err := h.findMovedMessage(mailbox, messageID)
+		if err != nil {
+			return err
+		}
+
+		if target != "" {
+			newPath := filepath.Join(h.folderPath(target), "cur", setFilenameUID(filepath.Base(path), targetUID))
+			fmt.Fprintf(h.out, " moving %s from %s to %s\n", messageID, mailbox, target)
+			return h.renameMessageFile(path, newPath)
+		}
+	}
+
+	fmt.Fprintf(h.out, " removing %s from %s\n", filepath.Base(path), mailbox)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	st := h.db.RemoveMessage(path)
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return errors.New(st.String())
+	}
+	return nil
+}
+
+// findMovedMessage looks for a message with a specific message id which we've seen in another mailbox,
+// but not downloaded since it was already available locally. It returns the mailbox and UID
+// of the message, or an empty string if no such message was found.
+func (h *Handler) findMovedMessage(mailbox string, messageID string) (string, uint32, error) {
+	h.mu.Lock()
+	candidates := make(map[string]uint32)
+	for otherMailbox, messages := range h.cfg.Messages {
+		if otherMailbox == mailbox {
+			continue
+		}
+		for uid, state := range messages {
+			if state.MessageID == messageID {
+				candidates[otherMailbox] = uid
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	for otherMailbox, uid := range candidates {
+		local, err := h.localUIDs(otherMailbox)
+		if err != nil {
+			return "", 0, err
+		}
+		if _, ok := local[uid]; !ok {
+			return otherMailbox, uid, nil
+		}
+	}
+	return "", 0, nil
+}
+
+func (h *Handler) deleteMessageState(mailbox string, uid uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.cfg.Messages[mailbox], uid)
+}
@@ -0,0 +1,332 @@
+package imap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/yzzyx/mr/source"
+)
+
+// defaultFlagTags maps IMAP flags to notmuch tags.
+// Tags prefixed with "-" are inverted, e.g. a message without the \Seen flag is tagged "unread"
+var defaultFlagTags = map[string]string{
+	imap.SeenFlag:     "-unread",
+	imap.FlaggedFlag:  "flagged",
+	imap.AnsweredFlag: "replied",
+	imap.DeletedFlag:  "deleted",
+}
+
+// flagMapping describes how a single IMAP flag is represented as a notmuch tag
+type flagMapping struct {
+	flag     string
+	tag      string
+	inverted bool // tag is set when flag is not set
+}
+
+// hasTag returns true if the flag state should be represented by the tag being set
+func (fm flagMapping) hasTag(flagSet bool) bool {
+	return flagSet != fm.inverted
+}
+
+// flagMappings returns the list of flags that should be synchronized,
+// based on the default mapping and the settings in FlagTags
+func (h *Handler) flagMappings() []flagMapping {
+	flagTags := make(map[string]string)
+	for flag, tag := range defaultFlagTags {
+		flagTags[flag] = tag
+	}
+	for flag, tag := range h.mailbox.FlagTags {
+		flagTags[imap.CanonicalFlag(flag)] = tag
+	}
+
+	mappings := make([]flagMapping, 0, len(flagTags))
+	for flag, tag := range flagTags {
+		// Mappings can be disabled by setting an empty tag
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		fm := flagMapping{flag: flag, tag: tag}
+		if strings.HasPrefix(tag, "-") {
+			fm.tag = tag[1:]
+			fm.inverted = true
+		}
+		mappings = append(mappings, fm)
+	}
+
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].flag < mappings[j].flag })
+	return mappings
+}
+
+// initialTags returns the tags to add and remove from a newly downloaded message, based on its IMAP flags
+func (h *Handler) initialTags(flags []string) (add []string, remove []string) {
+	flagSet := source.StringSet(flags)
+	for _, fm := range h.flagMappings() {
+		if fm.hasTag(flagSet[fm.flag]) {
+			add = append(add, fm.tag)
+		} else {
+			remove = append(remove, fm.tag)
+		}
+	}
+	return add, remove
+}
+
+// mappedFlags returns a sorted list of the flags in 'flags' which are synchronized
+func (h *Handler) mappedFlags(flags []string) []string {
+	flagSet := source.StringSet(flags)
+	result := []string{}
+	for _, fm := range h.flagMappings() {
+		if flagSet[fm.flag] {
+			result = append(result, fm.flag)
+		}
+	}
+	return result
+}
+
+// flagChanges collects the flag updates that should be sent to the server
+type flagChanges struct {
+	add    map[string]*imap.SeqSet
+	remove map[string]*imap.SeqSet
+}
+
+func (fc *flagChanges) update(flag string, uid uint32, set bool) {
+	m := fc.remove
+	if set {
+		m = fc.add
+	}
+	if m[flag] == nil {
+		m[flag] = new(imap.SeqSet)
+	}
+	m[flag].AddNum(uid)
+}
+
+// store sends all collected flag updates to the server
+func (fc *flagChanges) store(c *client.Client) error {
+	for op, changes := range map[imap.FlagsOp]map[string]*imap.SeqSet{
+		imap.AddFlags:    fc.add,
+		imap.RemoveFlags: fc.remove,
+	} {
+		for flag, seqSet := range changes {
+			err := c.UidStore(seqSet, imap.FormatFlagsOp(op, true), []interface{}{flag}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncFlags synchronizes IMAP flags and notmuch tags for all known messages in the folder selected by selectFolder
+func (h *Handler) syncFlags(c *client.Client, fs *folderSync) error {
+	if !h.mailbox.SyncFlags {
+		return nil
+	}
+
+	mailbox := fs.mailbox
+	lastSeenUID := h.getLastSeenUID(mailbox)
+	if lastSeenUID == 0 {
+		return nil
+	}
+
+	remoteStates, err := h.remoteStates(c, fs, lastSeenUID)
+	if err != nil {
+		return err
+	}
+
+	// Messages seen before we kept track of message ids need to be looked up
+	unknown := new(imap.SeqSet)
+	for uid := range remoteStates {
+		if h.getMessageState(mailbox, uid) == nil {
+			unknown.AddNum(uid)
+		}
+	}
+	if !unknown.Empty() {
+		err = uidFetch(c, unknown, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, func(msg *imap.Message) error {
+			if msg.Envelope == nil {
+				return nil
+			}
+			h.setMessageState(mailbox, msg.Uid, &messageState{MessageID: normalizeMessageID(msg.Envelope.MessageId)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	changes := flagChanges{
+		add:    make(map[string]*imap.SeqSet),
+		remove: make(map[string]*imap.SeqSet),
+	}
+	labels := labelChanges{
+		add:    make(map[string]*imap.SeqSet),
+		remove: make(map[string]*imap.SeqSet),
+	}
+	mappings := h.flagMappings()
+	newStates := make(map[uint32]*messageState)
+
+	h.db.Lock()
+	for uid, remoteState := range remoteStates {
+		state := h.getMessageState(mailbox, uid)
+		if state == nil || state.MessageID == "" {
+			continue
+		}
+
+		tags, ok := source.LocalTags(h.db, state.MessageID)
+		if !ok {
+			continue
+		}
+
+		remote := source.StringSet(remoteState.Flags)
+		last := source.StringSet(state.Flags)
+		haveLast := state.Flags != nil
+
+		var addTags, removeTags, tagChanges []string
+		for _, fm := range mappings {
+			local := tags[fm.tag] == fm.hasTag(true)
+			merged := source.MergeFlag(remote[fm.flag], local, last[fm.flag], haveLast)
+
+			if merged != remote[fm.flag] {
+				changes.update(fm.flag, uid, merged)
+			}
+			if merged != local {
+				if fm.hasTag(merged) {
+					addTags = append(addTags, fm.tag)
+					tagChanges = append(tagChanges, "+"+fm.tag)
+				} else {
+					removeTags = append(removeTags, fm.tag)
+					tagChanges = append(tagChanges, "-"+fm.tag)
+				}
+			}
+			remote[fm.flag] = merged
+		}
+
+		var mergedLabels []string
+		if h.mailbox.Gmail {
+			var labelAdd, labelRemove []string
+			mergedLabels, labelAdd, labelRemove = h.mergeLabels(uid, remoteState.Labels, state.Labels, tags, &labels)
+			for _, tag := range labelAdd {
+				addTags = append(addTags, tag)
+				tagChanges = append(tagChanges, "+"+tag)
+			}
+			for _, tag := range labelRemove {
+				removeTags = append(removeTags, tag)
+				tagChanges = append(tagChanges, "-"+tag)
+			}
+		}
+
+		if len(addTags) > 0 || len(removeTags) > 0 {
+			m, _ := h.db.FindMessage(state.MessageID)
+			if m != nil {
+				m.Freeze()
+				for _, tag := range addTags {
+					m.AddTag(tag)
+				}
+				for _, tag := range removeTags {
+					m.RemoveTag(tag)
+				}
+				m.Thaw()
+				m.TagsToMaildirFlags()
+				m.Destroy()
+			}
+			fmt.Fprintf(h.out, " updating tags for %s: %s\n", state.MessageID, strings.Join(tagChanges, ","))
+		}
+
+		mergedFlags := make([]string, 0, len(remote))
+		for flag, set := range remote {
+			if set {
+				mergedFlags = append(mergedFlags, flag)
+			}
+		}
+		newStates[uid] = &messageState{
+			MessageID:     state.MessageID,
+			Flags:         h.mappedFlags(mergedFlags),
+			Partial:       state.Partial,
+			GmailMsgID:    state.GmailMsgID,
+			GmailThreadID: state.GmailThreadID,
+			Labels:        mergedLabels,
+		}
+	}
+	h.db.Unlock()
+
+	err = changes.store(c)
+	if err != nil {
+		return err
+	}
+	err = labels.store(c)
+	if err != nil {
+		return err
+	}
+
+	// Only remember the new state once the server has been updated,
+	// otherwise local changes would be overwritten on the next synchronization
+	for uid, state := range newStates {
+		h.setMessageState(mailbox, uid, state)
+	}
+	return nil
+}
+
+// remoteStates returns the current flags (and labels in Gmail mode) on the server for all messages we've seen in a folder.
+// If the server supports CONDSTORE, only flags that have changed since the last pass are fetched,
+// and the others are assumed to be the same as when they were last synchronized.
+func (h *Handler) remoteStates(c *client.Client, fs *folderSync, lastSeenUID uint32) (map[uint32]*messageState, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, lastSeenUID)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+	if h.mailbox.Gmail {
+		items = append(items, gmailLabels)
+	}
+
+	remoteStates := make(map[uint32]*messageState)
+	setState := func(msg *imap.Message) error {
+		remoteStates[msg.Uid] = &messageState{Flags: msg.Flags, Labels: gmailLabelList(msg)}
+		return nil
+	}
+
+	if fs.lastModSeq == 0 {
+		err := uidFetch(c, seqSet, items, setState)
+		return remoteStates, err
+	}
+
+	// Messages whose flags have never been synchronized are always fetched
+	unsynced := new(imap.SeqSet)
+	h.mu.Lock()
+	for uid, state := range h.cfg.Messages[fs.mailbox] {
+		if state.Flags == nil || (h.mailbox.Gmail && state.Labels == nil) {
+			unsynced.AddNum(uid)
+		} else {
+			remoteStates[uid] = &messageState{Flags: state.Flags, Labels: state.Labels}
+		}
+	}
+	h.mu.Unlock()
+
+	if !fs.unchanged() {
+		_, err := uidFetchChanged(c, seqSet, items, fs.lastModSeq, false, setState)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !unsynced.Empty() {
+		err := uidFetch(c, unsynced, items, setState)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return remoteStates, nil
+}
+
+// RequestSync asks all folder watchers to synchronize flags and tags with the server.
+// It does not block, and has no effect if Idle hasn't been called.
+func (h *Handler) RequestSync() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.syncRequests {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package imap
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/yzzyx/mr/source"
+)
+
+// setFolderDelimiter remembers the hierarchy delimiter of a folder, as returned by LIST
+func (h *Handler) setFolderDelimiter(mailbox, delimiter string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.delimiters == nil {
+		h.delimiters = make(map[string]string)
+	}
+	h.delimiters[mailbox] = delimiter
+	if delimiter != "" {
+		h.delimiter = delimiter
+	}
+}
+
+// folderDelimiter returns the hierarchy delimiter of a folder.
+// Folders that haven't been listed (e.g. targets of TagFolders) use the delimiter of the other folders.
+func (h *Handler) folderDelimiter(mailbox string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if delimiter, ok := h.delimiters[mailbox]; ok {
+		return delimiter
+	}
+	return h.delimiter
+}
+
+// localFolder returns the path of the maildir of a folder, relative to the maildir path of the handler
+func (h *Handler) localFolder(mailbox string) string {
+	parts := []string{mailbox}
+	if delimiter := h.folderDelimiter(mailbox); delimiter != "" {
+		parts = strings.Split(mailbox, delimiter)
+	}
+	return source.LocalFolder(parts, h.mailbox.Layout)
+}
+
+// folderPath returns the absolute path of the maildir of a folder
+func (h *Handler) folderPath(mailbox string) string {
+	return filepath.Join(h.maildirPath, h.localFolder(mailbox))
+}
+
+// remoteFolder returns the name of the folder on the server stored in a local maildir,
+// which is the reverse of localFolder. 'local' is relative to the maildir path of the handler.
+func (h *Handler) remoteFolder(local string) string {
+	// Prefer known folders, since escaped names can't be mapped back
+	h.mu.Lock()
+	var known []string
+	for mailbox := range h.delimiters {
+		known = append(known, mailbox)
+	}
+	delimiter := h.delimiter
+	h.mu.Unlock()
+
+	for _, mailbox := range known {
+		if h.localFolder(mailbox) == local {
+			return mailbox
+		}
+	}
+
+	var parts []string
+	if h.mailbox.Layout == source.LayoutMaildirPlusPlus {
+		parts = strings.Split(strings.TrimPrefix(local, "."), ".")
+	} else {
+		parts = strings.Split(filepath.ToSlash(local), "/")
+	}
+	if delimiter == "" {
+		return strings.Join(parts, "")
+	}
+	return strings.Join(parts, delimiter)
+}
+
+// isFolderPattern returns true if a folder name in the configuration is a glob pattern
+func isFolderPattern(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?")
+}
+
+// matchFolder returns true if a folder matches a name or glob pattern from the configuration.
+// In patterns, "*" matches any number of characters (including the hierarchy delimiter),
+// and "?" matches a single character.
+func matchFolder(pattern, mailbox string) bool {
+	if pattern == mailbox {
+		return true
+	}
+	if !isFolderPattern(pattern) {
+		return false
+	}
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	matched, _ := regexp.MatchString("^"+expr+"$", mailbox)
+	return matched
+}
+
+// folderTagRule is a compiled rule from FolderTags
+type folderTagRule struct {
+	name string
+	re   *regexp.Regexp
+	tags string
+}
+
+// compileFolderTags compiles the rules in FolderTags, sorted by name.
+// An error is returned if a rule isn't a valid regular expression.
+func compileFolderTags(folderTags map[string]string) ([]folderTagRule, error) {
+	rules := make([]folderTagRule, 0, len(folderTags))
+	for name, tags := range folderTags {
+		re, err := regexp.Compile("^(?:" + name + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid folder_tags pattern %q: %s", name, err)
+		}
+		rules = append(rules, folderTagRule{name: name, re: re, tags: tags})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].name < rules[j].name })
+	return rules, nil
+}
+
+// folderTags returns the tag changes that should be applied to messages in a folder, from FolderTags.
+// Folders are either matched by their exact name, or by a regular expression matching the whole name,
+// in which case "$1" etc. in the tags are replaced with the submatches.
+func (h *Handler) folderTags(mailbox string) []string {
+	var tags []string
+	for _, rule := range h.folderTagRules {
+		tagList := rule.tags
+		if rule.name != mailbox {
+			match := rule.re.FindStringSubmatchIndex(mailbox)
+			if match == nil {
+				continue
+			}
+			tagList = string(rule.re.ExpandString(nil, tagList, mailbox, match))
+		}
+
+		for _, tag := range strings.Split(tagList, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && tag != "-" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,232 @@
+package imap
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/yzzyx/mr/source"
+)
+
+// Gmail IMAP extensions, see https://developers.google.com/gmail/imap/imap-extensions
+const (
+	gmailMsgID    imap.FetchItem = "X-GM-MSGID"
+	gmailThreadID imap.FetchItem = "X-GM-THRID"
+	gmailLabels   imap.FetchItem = "X-GM-LABELS"
+
+	// Special-use attribute of the folder containing all messages (RFC 6154)
+	allMailAttr = "\\All"
+)
+
+// defaultLabelTags maps Gmail system labels to notmuch tags.
+// Other labels are used as tags as they are.
+var defaultLabelTags = map[string]string{
+	"\\Inbox":     "inbox",
+	"\\Important": "important",
+	"\\Sent":      "sent",
+	"\\Draft":     "draft",
+	"\\Starred":   "", // Represented by the \Flagged flag
+}
+
+// labelTag returns the notmuch tag matching a Gmail label, or an empty string if the label isn't synchronized
+func (h *Handler) labelTag(label string) string {
+	if tag, ok := h.mailbox.LabelTags[label]; ok {
+		return tag
+	}
+	if tag, ok := defaultLabelTags[label]; ok {
+		return tag
+	}
+	if strings.HasPrefix(label, "\\") {
+		return strings.ToLower(label[1:])
+	}
+	return label
+}
+
+// gmailItems returns the Gmail specific items that should be fetched along with new messages
+func (h *Handler) gmailItems() []imap.FetchItem {
+	if !h.mailbox.Gmail {
+		return nil
+	}
+	return []imap.FetchItem{gmailMsgID, gmailThreadID, gmailLabels}
+}
+
+// gmailIDs returns the X-GM-MSGID and X-GM-THRID of a message, if they were fetched
+func gmailIDs(msg *imap.Message) (msgID uint64, threadID uint64) {
+	if v, ok := msg.Items[gmailMsgID]; ok {
+		msgID, _ = parseNumber64(v)
+	}
+	if v, ok := msg.Items[gmailThreadID]; ok {
+		threadID, _ = parseNumber64(v)
+	}
+	return msgID, threadID
+}
+
+// gmailLabelList returns the X-GM-LABELS of a message, or nil if they weren't fetched
+func gmailLabelList(msg *imap.Message) []string {
+	v, ok := msg.Items[gmailLabels]
+	if !ok {
+		return nil
+	}
+
+	fields, _ := v.([]interface{})
+	labels := make([]string, 0, len(fields))
+	for _, f := range fields {
+		label, err := imap.ParseString(f)
+		if err != nil {
+			continue
+		}
+
+		// Labels other than system labels are encoded like mailbox names
+		if !strings.HasPrefix(label, "\\") {
+			if decoded, err := utf7.Encoding.NewDecoder().String(label); err == nil {
+				label = decoded
+			}
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// allMailFolder returns the folder containing all messages, which is the only folder synchronized in Gmail mode,
+// and its hierarchy delimiter
+func allMailFolder(c *client.Client) (string, string, error) {
+	mboxChan := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mboxChan)
+	}()
+
+	var folder, delimiter string
+	for mb := range mboxChan {
+		for _, attr := range mb.Attributes {
+			if attr == allMailAttr {
+				folder = mb.Name
+				delimiter = mb.Delimiter
+			}
+		}
+	}
+
+	if err := <-done; err != nil {
+		return "", "", err
+	}
+	if folder == "" {
+		return "", "", errors.New("could not find the Gmail \"All Mail\" folder")
+	}
+	return folder, delimiter, nil
+}
+
+// labelChanges collects the label updates that should be sent to the server
+type labelChanges struct {
+	add    map[string]*imap.SeqSet
+	remove map[string]*imap.SeqSet
+}
+
+func (lc *labelChanges) update(label string, uid uint32, set bool) {
+	m := lc.remove
+	if set {
+		m = lc.add
+	}
+	if m[label] == nil {
+		m[label] = new(imap.SeqSet)
+	}
+	m[label].AddNum(uid)
+}
+
+// store sends all collected label updates to the server
+func (lc *labelChanges) store(c *client.Client) error {
+	for op, changes := range map[string]map[string]*imap.SeqSet{
+		"+X-GM-LABELS.SILENT": lc.add,
+		"-X-GM-LABELS.SILENT": lc.remove,
+	} {
+		for label, seqSet := range changes {
+			// System labels are atoms, other labels are strings encoded like mailbox names
+			var value interface{} = imap.RawString(label)
+			if !strings.HasPrefix(label, "\\") {
+				encoded, err := utf7.Encoding.NewEncoder().String(label)
+				if err != nil {
+					return err
+				}
+				value = encoded
+			}
+
+			cmd := &commands.Uid{Cmd: &commands.Store{
+				SeqSet: seqSet,
+				Item:   imap.StoreItem(op),
+				Value:  []interface{}{value},
+			}}
+			status, err := c.Execute(cmd, nil)
+			if err != nil {
+				return err
+			}
+			if err = status.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tagLabels returns the Gmail labels that are represented by the tags in 'tags'.
+// Only labels that are explicitly mapped in LabelTags or defaultLabelTags are included,
+// other tags would otherwise all become labels on the server.
+func (h *Handler) tagLabels(tags map[string]bool) []string {
+	var labels []string
+	for _, labelTags := range []map[string]string{defaultLabelTags, h.mailbox.LabelTags} {
+		for label := range labelTags {
+			if tag := h.labelTag(label); tag != "" && tags[tag] {
+				labels = append(labels, label)
+			}
+		}
+	}
+	return labels
+}
+
+// mergeLabels performs a three-way merge of the labels of a message, in the same way as source.MergeFlag.
+// It returns the merged list of labels, and the tags that should be added and removed locally.
+// Labels that should be changed on the server are added to 'changes'.
+func (h *Handler) mergeLabels(uid uint32, remote, last []string, tags map[string]bool, changes *labelChanges) (merged, addTags, removeTags []string) {
+	remoteSet := source.StringSet(remote)
+	lastSet := source.StringSet(last)
+	haveLast := last != nil
+
+	candidates := make(map[string]bool)
+	for _, list := range [][]string{remote, last, h.tagLabels(tags)} {
+		for _, label := range list {
+			candidates[label] = true
+		}
+	}
+
+	merged = []string{}
+	for label := range candidates {
+		tag := h.labelTag(label)
+		if tag == "" {
+			// Labels without a tag are left as they are on the server
+			if remoteSet[label] {
+				merged = append(merged, label)
+			}
+			continue
+		}
+
+		local := tags[tag]
+		set := source.MergeFlag(remoteSet[label], local, lastSet[label], haveLast)
+		if set != remoteSet[label] {
+			changes.update(label, uid, set)
+		}
+		if set != local {
+			if set {
+				addTags = append(addTags, tag)
+			} else {
+				removeTags = append(removeTags, tag)
+			}
+		}
+		if set {
+			merged = append(merged, label)
+		}
+	}
+	sort.Strings(merged)
+	return merged, addTags, removeTags
+}
@@ -0,0 +1,246 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+const (
+	// Servers may drop connections that have been idle for 30 minutes (RFC 2177),
+	// so we restart the IDLE command well before that
+	idleRestartInterval = 10 * time.Minute
+
+	// Used for servers which don't support IDLE
+	pollInterval = 1 * time.Minute
+
+	// Delays between reconnection attempts
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// idleCommand is an IDLE command, as defined in RFC 2177
+type idleCommand struct{}
+
+func (cmd *idleCommand) Command() *imap.Command {
+	return &imap.Command{Name: "IDLE"}
+}
+
+// idleResponse waits for the servers continuation request, and
+// ends the IDLE command by sending DONE when stop is closed.
+// Since the client doesn't know about VANISHED responses (sent instead of EXPUNGE
+// when QRESYNC is enabled), they are reported on vanished
+type idleResponse struct {
+	stop     <-chan struct{}
+	vanished chan<- struct{}
+	replies  chan []byte
+
+	gotContinuationReq bool
+}
+
+func (r *idleResponse) Replies() <-chan []byte {
+	return r.replies
+}
+
+func (r *idleResponse) Handle(resp imap.Resp) error {
+	if _, ok := resp.(*imap.ContinuationReq); ok && !r.gotContinuationReq {
+		r.gotContinuationReq = true
+		go func() {
+			<-r.stop
+			r.replies <- []byte("DONE\r\n")
+		}()
+		return nil
+	}
+	if name, _, ok := imap.ParseNamedResp(resp); ok && name == "VANISHED" {
+		select {
+		case r.vanished <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	return responses.ErrUnhandled
+}
+
+// idle sends an IDLE command to the server, and blocks until stop is closed
+func idle(c *client.Client, stop <-chan struct{}, vanished chan<- struct{}) error {
+	res := &idleResponse{
+		stop:     stop,
+		vanished: vanished,
+		replies:  make(chan []byte, 1),
+	}
+	status, err := c.Execute(&idleCommand{}, res)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// Watch starts watching the folders listed in IdleFolders (defaults to INBOX) in the background.
+// Each folder gets its own connection, and new messages are downloaded as soon as the server
+// reports them. If SyncFlags is set, flags are synchronized after each update, and whenever
+// RequestSync is called. After each update, a value is sent to notify (if it isn't already full).
+// The watchers are stopped by Close.
+func (h *Handler) Watch(notify chan<- struct{}) {
+	folders := h.mailbox.IdleFolders
+	if len(folders) == 0 {
+		folders = []string{"INBOX"}
+	}
+
+	// In Gmail mode, new messages are found in the "All Mail" folder (set by ListFolders)
+	h.mu.Lock()
+	if h.mailbox.Gmail && h.allMailFolder != "" {
+		folders = []string{h.allMailFolder}
+	}
+	h.mu.Unlock()
+
+	for _, folder := range folders {
+		syncRequest := make(chan struct{}, 1)
+		h.mu.Lock()
+		h.syncRequests = append(h.syncRequests, syncRequest)
+		h.mu.Unlock()
+
+		h.wg.Add(1)
+		go func(folder string) {
+			defer h.wg.Done()
+			h.watch(folder, syncRequest, notify)
+		}(folder)
+	}
+}
+
+// watch keeps a folder watcher running, and reconnects with an increasing delay if it fails
+func (h *Handler) watch(mailbox string, syncRequest <-chan struct{}, notify chan<- struct{}) {
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := h.watchFolder(mailbox, syncRequest, notify)
+		if err == nil {
+			// We've been asked to stop
+			return
+		}
+
+		// Start over with a short delay if the connection was up for a while
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		fmt.Fprintf(h.out, "watching %s failed: %s, reconnecting in %s\n", mailbox, err, delay)
+
+		select {
+		case <-h.done:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// watchFolder fetches new messages from a folder each time the server notifies us about changes.
+// It returns nil when the handler is closed, and an error if the connection fails.
+func (h *Handler) watchFolder(mailbox string, syncRequest <-chan struct{}, notify chan<- struct{}) error {
+	c, conn, err := h.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	// Note that blocking the update channel blocks the whole client,
+	// so updates are collapsed into a single pending change here
+	updates := make(chan client.Update, 10)
+	changed := make(chan struct{}, 1)
+	c.Updates = updates
+	go func() {
+		for {
+			select {
+			case <-c.LoggedOut():
+				return
+			case u := <-updates:
+				switch u.(type) {
+				case *client.MailboxUpdate, *client.ExpungeUpdate, *client.MessageUpdate:
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	supportsIdle, err := c.Support("IDLE")
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = h.syncFolder(c, mailbox)
+		if err != nil {
+			if h.closed() {
+				// The synchronization was interrupted because we've been asked to stop
+				return nil
+			}
+			return err
+		}
+		h.checkpoint()
+
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+
+		// The server isn't expected to send anything while we're waiting
+		conn.Pause()
+
+		if !supportsIdle {
+			select {
+			case <-h.done:
+				return nil
+			case <-syncRequest:
+			case <-time.After(pollInterval):
+			}
+			conn.Resume()
+			continue
+		}
+
+		stop := make(chan struct{})
+		// The timeout applies again once IDLE has been stopped, while waiting for the server to respond
+		stopIdle := func() {
+			conn.Resume()
+			close(stop)
+		}
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- idle(c, stop, changed)
+		}()
+
+		select {
+		case <-h.done:
+			stopIdle()
+			<-idleDone
+			return nil
+		case <-changed:
+			stopIdle()
+			err = <-idleDone
+		case <-syncRequest:
+			stopIdle()
+			err = <-idleDone
+		case <-time.After(idleRestartInterval):
+			stopIdle()
+			err = <-idleDone
+		case err = <-idleDone:
+			stopIdle()
+			if err == nil {
+				err = errors.New("server ended IDLE")
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -1,23 +1,21 @@
 package imap
 
 import (
-	"crypto/md5"
-	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"math"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/yzzyx/mr/internal/tagnames"
 	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/oauth2"
+	"github.com/yzzyx/mr/source"
 )
 
 // Mailbox defines the available options for a IMAP mailbox to pull from
@@ -28,17 +26,88 @@ type Mailbox struct {
 	Password    string
 	UseTLS      bool `yaml:"use_tls"`
 	UseStartTLS bool `yaml:"use_starttls"`
-	Folders     struct {
+
+	// Certificate settings used with both use_tls and use_starttls
+	TLS TLSConfig `yaml:"tls"`
+
+	// Timeouts in seconds: for opening a connection, and for waiting on the server
+	ConnectTimeout int `yaml:"connect_timeout"`
+	Timeout        int
+
+	// Alternatives to storing the password in the configuration file:
+	// a command which prints the password, or a file containing it (decrypted with gpg if it ends with .gpg or .asc)
+	PasswordCommand string `yaml:"password_command"`
+	PasswordFile    string `yaml:"password_file"`
+
+	// Authentication method, either "plain" (default), "xoauth2" or "oauthbearer"
+	Auth   string
+	OAuth2 oauth2.Config `yaml:"oauth2"`
+
+	Folders struct {
 		Include []string
 		Exclude []string
 	}
 
 	FolderTags map[string]string `yaml:"folder_tags"`
+
+	// Limits on which messages are downloaded, per folder
+	FolderOptions map[string]FolderOptions `yaml:"folder_options"`
+
+	// Keep a connection open and wait for new messages using IMAP IDLE
+	Idle        bool
+	IdleFolders []string `yaml:"idle_folders"`
+
+	// Synchronize IMAP flags and notmuch tags in both directions
+	SyncFlags bool `yaml:"sync_flags"`
+	// Map from IMAP flags to notmuch tags, overrides the default mapping
+	FlagTags map[string]string `yaml:"flag_tags"`
+
+	// Number of connections used to download messages in parallel (defaults to 1)
+	Connections int
+
+	// Upload messages that have been added to the local maildir of any folder to the server.
+	// Uploading can also be enabled for some folders only, in FolderOptions
+	Upload bool
+
+	// Map from notmuch tags to IMAP folders, messages which are tagged are moved to the folder
+	TagFolders map[string]string `yaml:"tag_folders"`
+
+	// Gmail mode: only "All Mail" is synchronized, and labels are represented by tags
+	Gmail bool
+	// Map from Gmail labels to notmuch tags, overrides the default mapping
+	LabelTags map[string]string `yaml:"label_tags"`
+
+	// Layout of folders in the local maildir, either "nested" (default) or "maildir++"
+	Layout string
 }
 
 type mailConfig struct {
+	// Version of the state format, see stateVersion
+	Version int
+
 	// Keep track of last seen UID for each mailbox
 	LastSeenUID map[string]uint32
+
+	// Keep track of UIDVALIDITY for each mailbox - if it changes, all UIDs we've stored are invalid
+	UIDValidity map[string]uint32
+
+	// Keep track of the messages in each mailbox, by UID
+	Messages map[string]map[uint32]*messageState
+
+	// Keep track of HIGHESTMODSEQ for each mailbox, if the server supports CONDSTORE
+	HighestModSeq map[string]uint64
+}
+
+// messageState describes a message on the server, as it looked when it was last synchronized
+type messageState struct {
+	MessageID string
+	Flags     []string // Synchronized flags set on the message, or nil if flags have never been synchronized
+	Partial   bool     `json:",omitempty"` // Only the headers of the message have been downloaded
+
+	// Only used in Gmail mode
+	GmailMsgID    uint64   `json:",omitempty"`
+	GmailThreadID uint64   `json:",omitempty"`
+	Labels        []string // Labels set on the message, or nil if labels have never been synchronized
 }
 
 // IndexUpdate is used to signal that a message should be tagged with specific information
@@ -56,11 +125,41 @@ type Handler struct {
 	mailbox     Mailbox
 
 	cfg mailConfig
+	// Protects cfg, which is shared between folder watchers
+	mu sync.Mutex
+	// Serializes writes of the state file
+	saveMu sync.Mutex
+	// Held while the handler is open, so that only one process synchronizes the mailbox
+	lockFile *os.File
+
+	// Progress information is written to out
+	out io.Writer
+
+	// Closed when the handler is shut down, used to stop folder watchers
+	done     chan struct{}
+	doneOnce sync.Once
+	wg       sync.WaitGroup
+
+	// Used to ask folder watchers to synchronize flags
+	syncRequests []chan struct{}
 
-	// Used internally to generate maildir files
-	seqNumChan <-chan int
-	processID  int
-	hostname   string
+	// Access tokens used for OAuth2 authentication
+	tokens *oauth2.TokenSource
+	// Password read from PasswordCommand or PasswordFile
+	cachedPassword string
+
+	// Compiled rules from FolderTags
+	folderTagRules []folderTagRule
+
+	// Name of the "All Mail" folder in Gmail mode
+	allMailFolder string
+
+	// Hierarchy delimiters of the folders on the server, and of the last listed folder
+	delimiters map[string]string
+	delimiter  string
+
+	// Connection used by the current synchronization pass, see Connect
+	session *session
 }
 
 // New creates a new Handler
@@ -70,132 +169,69 @@ func New(db *notmuch.Database,
 
 	var err error
 	h := Handler{}
-	h.hostname, err = os.Hostname()
+	err = source.CheckLayout(mailbox.Layout)
+	if err != nil {
+		return nil, err
+	}
+	h.folderTagRules, err = compileFolderTags(mailbox.FolderTags)
 	if err != nil {
 		return nil, err
 	}
 
 	h.mailbox = mailbox
-
-	// Generate unique sequence numbers
-	seqNumChan := make(chan int)
-	go func() {
-		seqNum := 1
-		for {
-			seqNumChan <- seqNum
-			seqNum++
-		}
-	}()
-	h.seqNumChan = seqNumChan
-	h.processID = os.Getpid()
+	h.out = os.Stdout
+	h.done = make(chan struct{})
 	h.db = db
 	h.maildirPath = maildirPath
+	h.tokens = oauth2.NewTokenSource(mailbox.OAuth2, filepath.Join(maildirPath, ".oauth2-token"))
 
-	h.cfg.LastSeenUID = make(map[string]uint32)
-	// Get list of timestamps etc.
-	data, err := ioutil.ReadFile(filepath.Join(maildirPath, ".imap-uids"))
+	err = os.MkdirAll(maildirPath, 0700)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
-		}
-	} else {
-		err = json.Unmarshal(data, &h.cfg)
-		if err != nil {
-			return nil, err
-		}
+		return nil, err
 	}
-	return &h, nil
-}
-
-// Close closes all open handles, flushes channels and saves configuration data
-func (h *Handler) Close() error {
-	data, err := json.Marshal(h.cfg)
+	err = h.lockState()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(h.maildirPath, ".imap-uids"), data, 0700)
+	// Get list of timestamps etc.
+	err = h.loadState()
 	if err != nil {
-		return err
+		h.unlockState()
+		return nil, err
 	}
-
-	return nil
+	return &h, nil
 }
 
-// getMessage downloads a message from the server from a mailbox, and stores it in a maildir
-func (h *Handler) getMessage(c *client.Client, mailbox string, uid uint32) error {
-	// Select INBOX
-	_, err := c.Select(mailbox, false)
-	if err != nil {
-		return err
-	}
-
-	// Get the whole message body
-	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{section.FetchItem()}
-	messages := make(chan *imap.Message, 1)
-
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
-
-	go func() {
-		if err := c.UidFetch(seqSet, items, messages); err != nil {
-			log.Fatal(err)
-		}
-	}()
-
-	msg := <-messages
-	if msg == nil {
-		return errors.New("Server didn't return message")
-	}
-
-	r := msg.GetBody(section)
-	if r == nil {
-		return errors.New("Server didn't return message body")
-	}
-
-	md5hash := md5.New()
-
-	tmpFilename := fmt.Sprintf("%d_%d.%d.%s,U=%d", time.Now().Unix(), <-h.seqNumChan, h.processID, h.hostname, uid)
-	mailboxPath := filepath.Join(h.maildirPath, mailbox)
-	tmpPath := filepath.Join(mailboxPath, "tmp", tmpFilename)
-
-	err = os.MkdirAll(filepath.Join(mailboxPath, "tmp"), 0700)
-	if err != nil {
-		return err
-	}
+// SetOutput sets the destination of progress information (defaults to os.Stdout)
+func (h *Handler) SetOutput(w io.Writer) {
+	h.out = w
+}
 
-	err = os.MkdirAll(filepath.Join(mailboxPath, "cur"), 0700)
-	if err != nil {
-		return err
-	}
+// Close closes all open handles, flushes channels and saves configuration data
+func (h *Handler) Close() error {
+	// Stop all folder watchers before saving their state
+	h.doneOnce.Do(func() { close(h.done) })
+	h.wg.Wait()
 
-	fd, err := os.Create(tmpPath)
-	if err != nil {
-		return err
-	}
+	defer h.unlockState()
+	return h.saveState()
+}
 
-	multiwriter := io.MultiWriter(fd, md5hash)
-	_, err = io.Copy(multiwriter, r)
-	if err != nil {
-		// Perform cleanup
-		_ = fd.Close()
-		_ = os.Remove(tmpPath)
-		return err
-	}
-	_ = fd.Close()
+// storeMessage stores a message downloaded from a mailbox in the maildir, and adds it to the index
+// If partial is set, r only contains the headers of the message.
+func (h *Handler) storeMessage(mailbox string, msg *imap.Message, r io.Reader, partial bool) error {
+	uid := msg.Uid
+	flags := msg.Flags
 
-	sum := fmt.Sprintf("%x", md5hash.Sum(nil))
-	newFilename := fmt.Sprintf("%s,FMD5=%s", tmpFilename, sum)
-	newPath := filepath.Join(mailboxPath, "cur", newFilename)
-	err = os.Rename(tmpPath, newPath)
+	newPath, err := source.StoreMaildirMessage(h.folderPath(mailbox), r, fmt.Sprintf(",U=%d", uid), maildirInfo(flags))
 	if err != nil {
-		// Could not rename file - discard old entry to avoid duplicates
-		_ = os.Remove(tmpPath)
 		return err
 	}
 
 	// Add file to index
+	h.db.Lock()
+	defer h.db.Unlock()
 	m, st := h.db.AddMessage(newPath)
 	if st == notmuch.STATUS_DUPLICATE_MESSAGE_ID {
 		// We've already seen this one
@@ -212,21 +248,52 @@ func (h *Handler) getMessage(c *client.Client, mailbox string, uid uint32) error
 		return errors.New(st.String())
 	}
 
-	// If we haven't seen it before, add an "unread" tag to it
-	m.AddTag("unread")
+	state := &messageState{MessageID: m.GetMessageId()}
+	state.GmailMsgID, state.GmailThreadID = gmailIDs(msg)
+	if partial {
+		state.Partial = true
+		m.AddTag(tagnames.Partial)
+	}
+	if h.mailbox.SyncFlags {
+		state.Flags = h.mappedFlags(flags)
 
-	// Add all messages to inbox
-	m.AddTag("inbox")
+		// Use the tags matching the flags on the server
+		addTags, removeTags := h.initialTags(flags)
+		for _, tag := range addTags {
+			m.AddTag(tag)
+		}
+		for _, tag := range removeTags {
+			m.RemoveTag(tag)
+		}
+	} else {
+		// If we haven't seen it before, add an "unread" tag to it
+		m.AddTag("unread")
+	}
 
-	// Add additional tags specified in config file
-	if extraTags, ok := h.mailbox.FolderTags[mailbox]; ok {
-		for _, tag := range strings.Split(extraTags, ",") {
-			if strings.HasPrefix(tag, "-") {
-				m.RemoveTag(tag[1:])
-			} else {
+	if h.mailbox.Gmail {
+		// The inbox tag is set by the \Inbox label
+		labels := gmailLabelList(msg)
+		for _, label := range labels {
+			if tag := h.labelTag(label); tag != "" {
 				m.AddTag(tag)
 			}
 		}
+		if h.mailbox.SyncFlags {
+			state.Labels = labels
+		}
+	} else {
+		// Add all messages to inbox
+		m.AddTag("inbox")
+	}
+	h.setMessageState(mailbox, uid, state)
+
+	// Add additional tags specified in config file
+	for _, tag := range h.folderTags(mailbox) {
+		if strings.HasPrefix(tag, "-") {
+			m.RemoveTag(tag[1:])
+		} else {
+			m.AddTag(tag)
+		}
 	}
 
 	tags := m.GetTags()
@@ -236,7 +303,7 @@ func (h *Handler) getMessage(c *client.Client, mailbox string, uid uint32) error
 		tags.MoveToNext()
 	}
 	if len(tagnames) > 0 {
-		fmt.Printf(" tagging %s: %s\n", tmpFilename, strings.Join(tagnames, ","))
+		fmt.Fprintf(h.out, " tagging %s: %s\n", filepath.Base(newPath), strings.Join(tagnames, ","))
 	}
 	m.Destroy()
 
@@ -286,6 +353,8 @@ func (h *Handler) getMessage(c *client.Client, mailbox string, uid uint32) error
 
 // GetLastFetched returns the timestamp when we last checked this mailbox
 func (h *Handler) getLastSeenUID(mailbox string) uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if uid, ok := h.cfg.LastSeenUID[mailbox]; ok {
 		return uid
 	}
@@ -293,34 +362,117 @@ func (h *Handler) getLastSeenUID(mailbox string) uint32 {
 }
 
 func (h *Handler) setLastSeenUID(mailbox string, uid uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.cfg.LastSeenUID[mailbox] = uid
 }
 
-// seenMessage returns true if we've already seen this message
-func (h *Handler) seenMessage(messageID string) bool {
-	// Remove surrounding tags
+// checkUIDValidity compares the UIDVALIDITY of a mailbox with the one we've previously seen.
+// If it has changed, all stored UIDs for the mailbox are discarded, and true is returned.
+// The new value is stored by setUIDValidity, once the mailbox has been resynchronized.
+func (h *Handler) checkUIDValidity(mailbox string, uidValidity uint32) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// If we haven't stored UIDVALIDITY before, we have to assume that our UIDs are valid
+	previous, ok := h.cfg.UIDValidity[mailbox]
+	if !ok || previous == uidValidity {
+		return false
+	}
+
+	fmt.Fprintf(h.out, "UIDVALIDITY of %s changed from %d to %d, resynchronizing\n", mailbox, previous, uidValidity)
+	delete(h.cfg.LastSeenUID, mailbox)
+	delete(h.cfg.Messages, mailbox)
+	delete(h.cfg.HighestModSeq, mailbox)
+	return true
+}
+
+func (h *Handler) setUIDValidity(mailbox string, uidValidity uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cfg.UIDValidity[mailbox] = uidValidity
+}
+
+// getMessageState returns the last synchronized state of a message, or nil if we haven't seen it
+func (h *Handler) getMessageState(mailbox string, uid uint32) *messageState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cfg.Messages[mailbox][uid]
+}
+
+func (h *Handler) setMessageState(mailbox string, uid uint32, state *messageState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cfg.Messages[mailbox] == nil {
+		h.cfg.Messages[mailbox] = make(map[uint32]*messageState)
+	}
+	h.cfg.Messages[mailbox][uid] = state
+}
+
+// gmailMessages returns the state of all messages we've seen, by X-GM-MSGID
+func (h *Handler) gmailMessages() map[uint64]*messageState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make(map[uint64]*messageState)
+	for _, messages := range h.cfg.Messages {
+		for _, state := range messages {
+			if state.GmailMsgID != 0 {
+				result[state.GmailMsgID] = state
+			}
+		}
+	}
+	return result
+}
+
+// normalizeMessageID removes surrounding brackets or quotes from a message id
+func normalizeMessageID(messageID string) string {
 	if (strings.HasPrefix(messageID, "<") && strings.HasSuffix(messageID, ">")) ||
 		(strings.HasPrefix(messageID, "\"") && strings.HasSuffix(messageID, "\"")) {
 		messageID = messageID[1 : len(messageID)-1]
 	}
+	return messageID
+}
+
+// seenMessage returns true if we've already seen this message
+func (h *Handler) seenMessage(messageID string) bool {
+	messageID = normalizeMessageID(messageID)
 
 	queryStr := fmt.Sprintf("id:\"%s\"", strings.Replace(messageID, "\"", "\\\"", -1))
+	h.db.Lock()
 	q := h.db.CreateQuery(queryStr)
 	matching := q.CountMessages()
 	q.Destroy()
+	h.db.Unlock()
 	if matching > 0 {
 		return true
 	}
 	return false
 }
 
-func (h *Handler) mailboxFetchMessages(c *client.Client, mailbox string) error {
-	mbox, err := c.Select(mailbox, false)
-	if err != nil {
-		return err
+// mailboxFetchMessages downloads all new messages in the folder selected by selectFolder
+func (h *Handler) mailboxFetchMessages(c *client.Client, fs *folderSync) error {
+	var err error
+	mailbox := fs.mailbox
+	mbox := fs.status
+
+	// If HIGHESTMODSEQ hasn't changed, there are no new messages
+	if fs.unchanged() {
+		return nil
+	}
+
+	// If UIDVALIDITY has changed, messages we've already downloaded to this mailbox
+	// are matched by their message id, so that they're not downloaded again
+	var localFiles map[string]string
+	if fs.uidValidityChanged {
+		localFiles, err = h.localMessageIDs(mailbox)
+		if err != nil {
+			return err
+		}
 	}
 
 	if mbox.Messages == 0 {
+		h.setUIDValidity(mailbox, mbox.UidValidity)
 		return nil
 	}
 
@@ -331,60 +483,147 @@ func (h *Handler) mailboxFetchMessages(c *client.Client, mailbox string) error {
 	//   lastSeenUID to '*', because the latter always returns at least one entry
 	seqSet.AddRange(lastSeenUID+1, math.MaxUint32)
 
-	// Fetch envelope information (contains messageid, and UID, which we'll use to fetch the body
-	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}
+	opts := h.folderOptions(mailbox)
+	if opts.MaxAge > 0 {
+		seqSet, err = searchSince(c, seqSet, opts.MaxAge)
+		if err != nil {
+			return err
+		}
 
-	messages := make(chan *imap.Message, 100)
-	errchan := make(chan error, 1)
+		// Older messages are skipped for good
+		if mbox.UidNext > lastSeenUID+1 {
+			lastSeenUID = mbox.UidNext - 1
+		}
+	}
 
-	go func() {
-		if err := c.UidFetch(seqSet, items, messages); err != nil {
-			errchan <- err
+	// Fetch envelope information (contains messageid, and UID, which we'll use to fetch the body
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size}
+
+	// In Gmail mode, messages we already have are found by their X-GM-MSGID, so the envelope
+	// is only fetched for the other messages, which are then matched by their message id.
+	// This keeps messages downloaded before Gmail mode was enabled from being downloaded again.
+	envelopeSet := seqSet
+	if h.mailbox.Gmail && !fs.uidValidityChanged {
+		gmailMessages := h.gmailMessages()
+		envelopeSet = new(imap.SeqSet)
+		err = uidFetch(c, seqSet, []imap.FetchItem{imap.FetchUid, gmailMsgID}, func(msg *imap.Message) error {
+			if msg.Uid > lastSeenUID {
+				lastSeenUID = msg.Uid
+			}
+
+			gmID, _ := gmailIDs(msg)
+			state, ok := gmailMessages[gmID]
+			if !ok || gmID == 0 {
+				envelopeSet.AddNum(msg.Uid)
+				return nil
+			}
+			if h.getMessageState(mailbox, msg.Uid) == nil {
+				h.setMessageState(mailbox, msg.Uid, &messageState{
+					MessageID:     state.MessageID,
+					GmailMsgID:    state.GmailMsgID,
+					GmailThreadID: state.GmailThreadID,
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-	}()
+		items = append(items, gmailMsgID, gmailThreadID)
+	}
 
 	var uidList []uint32
-	for msg := range messages {
-		if msg == nil {
-			// We're done
-			break
+	partial := make(map[uint32]bool)
+	addToList := func(msg *imap.Message) {
+		uidList = append(uidList, msg.Uid)
+		if opts.headersOnly(msg.Size) {
+			partial[msg.Uid] = true
+		}
+	}
+	checkEnvelope := func(msg *imap.Message) error {
+		if msg.Uid > lastSeenUID {
+			lastSeenUID = msg.Uid
 		}
 
 		if msg.Envelope == nil {
 			return errors.New("server returned empty envelope")
 		}
 
-		if msg.Uid > lastSeenUID {
-			lastSeenUID = msg.Uid
+		messageID := normalizeMessageID(msg.Envelope.MessageId)
+		state := &messageState{MessageID: messageID}
+		state.GmailMsgID, state.GmailThreadID = gmailIDs(msg)
+		if path, ok := localFiles[messageID]; ok {
+			// Already stored in this mailbox, but with the old UID
+			delete(localFiles, messageID)
+			h.setMessageState(mailbox, msg.Uid, state)
+			return h.updateFileUID(path, msg.Uid)
 		}
 
 		if h.seenMessage(msg.Envelope.MessageId) {
 			// We've already seen this message
-			fmt.Println("Already seen", msg.Uid, msg.Envelope.MessageId)
-			continue
+			fmt.Fprintln(h.out, "Already seen", msg.Uid, msg.Envelope.MessageId)
+			if h.getMessageState(mailbox, msg.Uid) == nil {
+				h.setMessageState(mailbox, msg.Uid, state)
+			}
+			return nil
 		}
-		fmt.Println("Adding to list", msg.Uid, msg.Envelope.MessageId)
-		uidList = append(uidList, msg.Uid)
-	}
-
-	// Check if an error occurred while fetching data
-	select {
-	case err := <-errchan:
-		return err
-	default:
+		fmt.Fprintln(h.out, "Adding to list", msg.Uid, msg.Envelope.MessageId)
+		addToList(msg)
+		return nil
 	}
-
-	for _, uid := range uidList {
-		err = h.getMessage(c, mailbox, uid)
+	if !envelopeSet.Empty() {
+		err = uidFetch(c, envelopeSet, items, checkEnvelope)
 		if err != nil {
 			return err
 		}
 	}
+
+	err = h.downloadMessages(c, mailbox, uidList, partial)
+	if err != nil {
+		return err
+	}
 	h.setLastSeenUID(mailbox, lastSeenUID)
+	h.setUIDValidity(mailbox, mbox.UidValidity)
 	return nil
 }
 
+// uidFetch fetches 'items' for the messages in seqSet, and calls fn for each returned message.
+// The first error returned by fn is returned after the command has completed.
+func uidFetch(c *client.Client, seqSet *imap.SeqSet, items []imap.FetchItem, fn func(msg *imap.Message) error) error {
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, items, messages)
+	}()
+
+	var fnErr error
+	for msg := range messages {
+		// Keep reading until the channel is closed, otherwise the client would block
+		if fnErr == nil {
+			fnErr = fn(msg)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return err
+	}
+	return fnErr
+}
+
 func (h *Handler) listFolders(c *client.Client) ([]string, error) {
+	// In Gmail mode, all messages are available in a single folder
+	if h.mailbox.Gmail {
+		folder, delimiter, err := allMailFolder(c)
+		if err != nil {
+			return nil, err
+		}
+		h.setFolderDelimiter(folder, delimiter)
+
+		h.mu.Lock()
+		h.allMailFolder = folder
+		h.mu.Unlock()
+		return []string{folder}, nil
+	}
 
 	includeAll := false
 	// If no specific folders are listed to be included, assume all folders should be included
@@ -392,18 +631,13 @@ func (h *Handler) listFolders(c *client.Client) ([]string, error) {
 		includeAll = true
 	}
 
-	// Make a map of included and excluded mailboxes
+	// Make a map of included folders and patterns
 	includedFolders := make(map[string]bool)
 	for _, folder := range h.mailbox.Folders.Include {
 		// Note - we set this to false to keep track of if it exists on the server or not
 		includedFolders[folder] = false
 	}
 
-	excludedFolders := make(map[string]bool)
-	for _, folder := range h.mailbox.Folders.Exclude {
-		excludedFolders[folder] = true
-	}
-
 	mboxChan := make(chan *imap.MailboxInfo, 10)
 	errChan := make(chan error, 1)
 	go func() {
@@ -419,16 +653,31 @@ func (h *Handler) listFolders(c *client.Client) ([]string, error) {
 			break
 		}
 
+		h.setFolderDelimiter(mb.Name, mb.Delimiter)
+
 		// Check if this mailbox should be excluded
-		if _, ok := excludedFolders[mb.Name]; ok {
+		excluded := false
+		for _, pattern := range h.mailbox.Folders.Exclude {
+			if matchFolder(pattern, mb.Name) {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
 			continue
 		}
 
 		if !includeAll {
-			if _, ok := includedFolders[mb.Name]; !ok {
+			included := false
+			for pattern := range includedFolders {
+				if matchFolder(pattern, mb.Name) {
+					includedFolders[pattern] = true
+					included = true
+				}
+			}
+			if !included {
 				continue
 			}
-			includedFolders[mb.Name] = true
 		}
 
 		folderNames = append(folderNames, mb.Name)
@@ -441,9 +690,10 @@ func (h *Handler) listFolders(c *client.Client) ([]string, error) {
 	default:
 	}
 
-	// Check if any of the specified folders were missing on the server
+	// Check if any of the specified folders were missing on the server.
+	// Patterns are allowed to match nothing
 	for folder, seen := range includedFolders {
-		if !seen {
+		if !seen && !isFolderPattern(folder) {
 			return nil, fmt.Errorf("folder %s not found on server", folder)
 		}
 	}
@@ -451,62 +701,106 @@ func (h *Handler) listFolders(c *client.Client) ([]string, error) {
 	return folderNames, nil
 }
 
-// CheckMessages checks for new/unindexed messages on the server
-func (h *Handler) CheckMessages() error {
+// connect opens a new authenticated connection to the server
+func (h *Handler) connect() (*client.Client, error) {
+	c, _, err := h.dial()
+	return c, err
+}
+
+// dial opens a new connection, like connect, and also returns the underlying network connection
+// so that its timeout can be paused
+func (h *Handler) dial() (*client.Client, *source.TimeoutConn, error) {
 	var c *client.Client
 	var err error
 
 	if h.mailbox.Server == "" {
-		return errors.New("imap server address not configured")
+		return nil, nil, errors.New("imap server address not configured")
 	}
 	if h.mailbox.Username == "" {
-		return errors.New("imap username not configured")
+		return nil, nil, errors.New("imap username not configured")
 	}
-	if h.mailbox.Password == "" {
-		return errors.New("imap password not configured")
+	err = h.checkCredentials()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Set default port
-	if h.mailbox.Port == 0 {
-		h.mailbox.Port = 143
+	port := h.mailbox.Port
+	if port == 0 {
+		port = 143
 		if h.mailbox.UseTLS {
-			h.mailbox.Port = 993
+			port = 993
 		}
 	}
 
-	connectionString := fmt.Sprintf("%s:%d", h.mailbox.Server, h.mailbox.Port)
-	tlsConfig := &tls.Config{ServerName: h.mailbox.Server}
+	connectionString := fmt.Sprintf("%s:%d", h.mailbox.Server, port)
+	tlsConfig, err := h.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dialer := h.newDialer()
 	if h.mailbox.UseTLS {
-		c, err = client.DialTLS(connectionString, tlsConfig)
+		c, err = client.DialWithDialerTLS(dialer, connectionString, tlsConfig)
 	} else {
-		c, err = client.Dial(connectionString)
+		c, err = client.DialWithDialer(dialer, connectionString)
 	}
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// Don't forget to logout
-	defer c.Logout()
-
 	// Start a TLS session
 	if h.mailbox.UseStartTLS {
 		if err := c.StartTLS(tlsConfig); err != nil {
-			return err
+			_ = c.Logout()
+			return nil, nil, err
 		}
 	}
 
-	err = c.Login(h.mailbox.Username, h.mailbox.Password)
+	err = h.authenticate(c, port)
+	if err != nil {
+		_ = c.Logout()
+		return nil, nil, err
+	}
+
+	err = enableQResync(c)
+	if err != nil {
+		_ = c.Logout()
+		return nil, nil, err
+	}
+	return c, dialer.conn, nil
+}
+
+// syncFolder fetches new messages from a folder, and synchronizes changes
+func (h *Handler) syncFolder(c *client.Client, mailbox string) error {
+	fs, err := h.selectFolder(c, mailbox)
 	if err != nil {
 		return err
 	}
 
-	mailboxes, err := h.listFolders(c)
-	for _, mb := range mailboxes {
-		err = h.mailboxFetchMessages(c, mb)
-		if err != nil {
-			return err
-		}
+	err = h.mailboxFetchMessages(c, fs)
+	if err != nil {
+		return err
 	}
-	return nil
+	return h.pushChanges(c, fs)
+}
+
+// pushChanges synchronizes flags, uploads and moves, and removes messages that have been deleted on the server
+func (h *Handler) pushChanges(c *client.Client, fs *folderSync) error {
+	err := h.syncFlags(c, fs)
+	if err != nil {
+		return err
+	}
+
+	err = h.uploadMessages(c, fs)
+	if err != nil {
+		return err
+	}
+
+	err = h.moveTagged(c, fs)
+	if err != nil {
+		return err
+	}
+	return h.syncDeletions(c, fs)
 }
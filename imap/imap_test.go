@@ -0,0 +1,555 @@
+package imap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/mr/internal/tagnames"
+	"github.com/yzzyx/mr/internal/testutil"
+	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
+)
+
+func TestListFolders(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	for _, folder := range []string{"Lists", "Lists/go", "Lists/rust", "Spam"} {
+		ts.createFolder(t, folder)
+	}
+
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected []string
+		fail     bool
+	}{
+		{name: "all", expected: []string{"INBOX", "Lists", "Lists/go", "Lists/rust", "Spam"}},
+		{name: "exclude", exclude: []string{"Spam", "Lists"}, expected: []string{"INBOX", "Lists/go", "Lists/rust"}},
+		{name: "include", include: []string{"INBOX", "Spam"}, expected: []string{"INBOX", "Spam"}},
+		{name: "include pattern", include: []string{"Lists/*"}, expected: []string{"Lists/go", "Lists/rust"}},
+		{name: "include and exclude", include: []string{"Lists/*"}, exclude: []string{"*/rust"}, expected: []string{"Lists/go"}},
+		{name: "unmatched pattern", include: []string{"INBOX", "Archive/*"}, expected: []string{"INBOX"}},
+		{name: "missing folder", include: []string{"INBOX", "Archive"}, fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := testutil.TempDir(t)
+			defer cleanup()
+
+			mailbox := ts.mailbox()
+			mailbox.Folders.Include = tt.include
+			mailbox.Folders.Exclude = tt.exclude
+			h := newTestHandler(t, nil, path, mailbox)
+			defer h.Close()
+
+			c, err := h.connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Logout()
+
+			folders, err := h.listFolders(c)
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("expected error, got folders %v", folders)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sort.Strings(folders)
+			if !reflect.DeepEqual(folders, tt.expected) {
+				t.Errorf("expected folders %v, got %v", tt.expected, folders)
+			}
+		})
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	host, port := unusedAddr(t)
+	wrongPassword := ts.mailbox()
+	wrongPassword.Password = "wrong"
+
+	tests := []struct {
+		name    string
+		mailbox Mailbox
+	}{
+		{name: "no server", mailbox: Mailbox{Username: "username", Password: "password"}},
+		{name: "no username", mailbox: Mailbox{Server: host, Port: port, Password: "password"}},
+		{name: "no password", mailbox: Mailbox{Server: host, Port: port, Username: "username"}},
+		{name: "connection refused", mailbox: Mailbox{Server: host, Port: port, Username: "username", Password: "password"}},
+		{name: "wrong password", mailbox: wrongPassword},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := testutil.TempDir(t)
+			defer cleanup()
+
+			h := newTestHandler(t, nil, path, tt.mailbox)
+			defer h.Close()
+
+			c, err := h.connect()
+			if err == nil {
+				c.Logout()
+				t.Fatal("expected connection to fail")
+			}
+		})
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+
+	h := newTestHandler(t, nil, path, Mailbox{})
+	h.setLastSeenUID("INBOX", 42)
+	h.setUIDValidity("INBOX", 7)
+	h.setMessageState("INBOX", 42, &messageState{MessageID: "test@example.org"})
+
+	// Only one handler at a time may use the same state
+	_, err := New(nil, h.maildirPath, Mailbox{})
+	if err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h = newTestHandler(t, nil, path, Mailbox{})
+	defer h.Close()
+	if uid := h.getLastSeenUID("INBOX"); uid != 42 {
+		t.Errorf("expected last seen UID 42, got %d", uid)
+	}
+	if state := h.getMessageState("INBOX", 42); state == nil || state.MessageID != "test@example.org" {
+		t.Errorf("message state not restored: %+v", state)
+	}
+	if h.cfg.Version != stateVersion {
+		t.Errorf("expected state version %d, got %d", stateVersion, h.cfg.Version)
+	}
+}
+
+func TestCheckMessages(t *testing.T) {
+	td := testutil.NewDatabase(t)
+	defer td.Close()
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	ts.addMessage(t, "Work", "work@example.org")
+	ts.addMessage(t, "Lists/go", "golang@example.org", "\\Seen")
+	// The same message in two folders is only stored once
+	ts.addMessage(t, "Archive", defaultMessageID)
+
+	mailbox := ts.mailbox()
+	mailbox.FolderTags = map[string]string{
+		"Work":         "work,-inbox",
+		"Lists/(.*)":   "list/$1",
+		"Unrelated/.*": "unrelated",
+	}
+	h := newTestHandler(t, td.DB, td.Path, mailbox)
+
+	err := h.CheckMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := td.Tags("work@example.org")
+	if !tags["work"] || tags["inbox"] || !tags["unread"] {
+		t.Errorf("unexpected tags for message in Work: %v", tags)
+	}
+	tags = td.Tags("golang@example.org")
+	if !tags["list/go"] || !tags["inbox"] || tags["unrelated"] {
+		t.Errorf("unexpected tags for message in Lists/go: %v", tags)
+	}
+	if td.Tags(defaultMessageID) == nil {
+		t.Errorf("message in INBOX not indexed")
+	}
+
+	inbox, archive := countFiles(t, h, "INBOX"), countFiles(t, h, "Archive")
+	if inbox+archive != 1 {
+		t.Errorf("expected duplicate message to be stored once, found %d in INBOX and %d in Archive", inbox, archive)
+	}
+
+	lastSeen := h.getLastSeenUID("Work")
+	if lastSeen == 0 {
+		t.Errorf("last seen UID of Work not updated")
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only new messages are downloaded after restarting
+	ts.addMessage(t, "Work", "work2@example.org")
+	h = newTestHandler(t, td.DB, td.Path, mailbox)
+	defer h.Close()
+	if uid := h.getLastSeenUID("Work"); uid != lastSeen {
+		t.Errorf("expected last seen UID %d after restart, got %d", lastSeen, uid)
+	}
+
+	err = h.CheckMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, h, "Work"); n != 2 {
+		t.Errorf("expected 2 messages in Work, found %d", n)
+	}
+	if td.Tags("work2@example.org") == nil {
+		t.Errorf("new message not indexed")
+	}
+}
+
+func TestCheckMessagesFolderFailure(t *testing.T) {
+	td := testutil.NewDatabase(t)
+	defer td.Close()
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	ts.addMessage(t, "Work", "work@example.org")
+
+	// A folder which can't be stored locally doesn't stop the others
+	mailbox := ts.mailbox()
+	h := newTestHandler(t, td.DB, td.Path, mailbox)
+	defer h.Close()
+	blockFolder(t, h, "Work")
+
+	err := h.CheckMessages()
+	syncErr, ok := err.(*source.SyncError)
+	if !ok {
+		t.Fatalf("expected SyncError, got %v", err)
+	}
+	if _, ok := syncErr.Failures["Work"]; !ok || len(syncErr.Failures) != 1 {
+		t.Errorf("expected only Work to fail, got %v", syncErr.Failures)
+	}
+	if td.Tags(defaultMessageID) == nil {
+		t.Errorf("message in INBOX not indexed")
+	}
+}
+
+func TestBatchProgress(t *testing.T) {
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+
+	h := newTestHandler(t, nil, path, Mailbox{})
+	batches := []*fetchBatch{{lastUID: 10}, {lastUID: 20}, {lastUID: 30}}
+	progress := newBatchProgress(h, "INBOX", batches)
+
+	// Batches stored over parallel connections may finish out of order
+	progress.batchStored(0)
+	progress.batchStored(2)
+	if uid := h.getLastSeenUID("INBOX"); uid != 10 {
+		t.Errorf("expected last seen UID 10 while batch 1 is missing, got %d", uid)
+	}
+
+	// The download is interrupted before batch 1 is stored
+	err := h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = newTestHandler(t, nil, path, Mailbox{})
+	if uid := h.getLastSeenUID("INBOX"); uid != 10 {
+		t.Errorf("expected saved last seen UID 10, got %d", uid)
+	}
+
+	progress = newBatchProgress(h, "INBOX", batches)
+	for i := range batches {
+		progress.batchStored(i)
+	}
+	if uid := h.getLastSeenUID("INBOX"); uid != 30 {
+		t.Errorf("expected last seen UID 30 after all batches, got %d", uid)
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	td := testutil.NewDatabase(t)
+	defer td.Close()
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	defer func(n int) { fetchBatchSize = n }(fetchBatchSize)
+	fetchBatchSize = 1
+
+	for _, messageID := range []string{"one@example.org", "two@example.org", "three@example.org"} {
+		ts.addMessage(t, "Work", messageID)
+	}
+
+	// The download of Work fails after the first batch
+	ts.failBody(2)
+	mailbox := ts.mailbox()
+	h := newTestHandler(t, td.DB, td.Path, mailbox)
+	err := h.CheckMessages()
+	if _, ok := err.(*source.SyncError); !ok {
+		t.Fatalf("expected SyncError, got %v", err)
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h = newTestHandler(t, td.DB, td.Path, mailbox)
+	defer h.Close()
+	if uid := h.getLastSeenUID("Work"); uid != 1 {
+		t.Errorf("expected saved last seen UID 1, got %d", uid)
+	}
+	if n := countFiles(t, h, "Work"); n != 1 {
+		t.Errorf("expected 1 message in Work after interrupted download, found %d", n)
+	}
+
+	// The remaining messages are downloaded by the next pass, and the first one isn't downloaded again
+	ts.failBody(0)
+	err = h.CheckMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, h, "Work"); n != 3 {
+		t.Errorf("expected 3 messages in Work, found %d", n)
+	}
+	if uid := h.getLastSeenUID("Work"); uid != 3 {
+		t.Errorf("expected last seen UID 3, got %d", uid)
+	}
+}
+
+func TestDownloadClosed(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.addMessage(t, "Work", "one@example.org")
+	ts.addMessage(t, "Work", "two@example.org")
+
+	defer func(n int) { fetchBatchSize = n }(fetchBatchSize)
+	fetchBatchSize = 1
+
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+	h := newTestHandler(t, nil, path, ts.mailbox())
+
+	c, err := h.connectMailbox("Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+
+	// A download which is still running when the handler is closed stops without storing anything
+	h.doneOnce.Do(func() { close(h.done) })
+	for _, connections := range []int{1, 2} {
+		h.mailbox.Connections = connections
+		err = h.downloadMessages(c, "Work", []uint32{1, 2}, nil)
+		if err != errClosed {
+			t.Errorf("expected errClosed with %d connection(s), got %v", connections, err)
+		}
+	}
+	if uid := h.getLastSeenUID("Work"); uid != 0 {
+		t.Errorf("expected no saved last seen UID, got %d", uid)
+	}
+
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewMissingMaildir(t *testing.T) {
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+
+	// New creates the maildir before taking the state lock
+	maildirPath := filepath.Join(path, "missing", "mailbox")
+	h, err := New(nil, maildirPath, Mailbox{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if _, err := os.Stat(filepath.Join(maildirPath, lockFilename)); err != nil {
+		t.Errorf("lock file not created: %s", err)
+	}
+}
+
+func TestNewInvalidFolderTags(t *testing.T) {
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+
+	mailbox := Mailbox{FolderTags: map[string]string{
+		"Lists/(.*)": "list/$1",
+		"Lists/(":    "list",
+	}}
+	h, err := New(nil, path, mailbox)
+	if err == nil {
+		h.Close()
+		t.Fatal("expected error for invalid folder_tags pattern")
+	}
+	if !strings.Contains(err.Error(), `"Lists/("`) {
+		t.Errorf("expected error to name the pattern, got %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, lockFilename)); !os.IsNotExist(err) {
+		t.Errorf("expected no lock file after error, got %v", err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.addMessage(t, "INBOX", "one@example.org")
+	ts.addMessage(t, "INBOX", "two@example.org")
+	ts.createFolder(t, "Archive")
+
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+	h := newTestHandler(t, nil, path, ts.mailbox())
+	defer h.Close()
+
+	// Pretend that the messages have been downloaded
+	c, err := h.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Select("INBOX", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+	err = uidFetch(c, seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, func(msg *imap.Message) error {
+		h.setMessageState("INBOX", msg.Uid, &messageState{MessageID: normalizeMessageID(msg.Envelope.MessageId)})
+		return nil
+	})
+	_ = c.Logout()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := h.Move([]string{"one@example.org", "two@example.org"}, "Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []string{"one@example.org", "two@example.org"}) {
+		t.Errorf("expected both messages to be found, got %v", found)
+	}
+
+	for folder, expected := range map[string]uint32{"INBOX": 1, "Archive": 2} {
+		mbox, err := ts.user.GetMailbox(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != expected {
+			t.Errorf("expected %d messages in %s, got %d", expected, folder, status.Messages)
+		}
+	}
+}
+
+func TestCopiedUIDs(t *testing.T) {
+	tests := []struct {
+		args     []interface{}
+		expected map[uint32]uint32
+	}{
+		{[]interface{}{uint32(38505), uint32(304), uint32(3956)}, map[uint32]uint32{304: 3956}},
+		{[]interface{}{uint32(38505), "304,319:320", "3956:3958"}, map[uint32]uint32{304: 3956, 319: 3957, 320: 3958}},
+		// The order of the sets is kept
+		{[]interface{}{uint32(38505), "320:319", "3956:3957"}, map[uint32]uint32{320: 3956, 319: 3957}},
+		// Sets of different sizes are ignored
+		{[]interface{}{uint32(38505), "1:3", "10:11"}, map[uint32]uint32{}},
+		{[]interface{}{uint32(38505), "1"}, map[uint32]uint32{}},
+	}
+
+	for _, test := range tests {
+		uids := make(map[uint32]uint32)
+		copiedUIDs(&imap.StatusResp{Code: "COPYUID", Arguments: test.args}, uids)
+		if !reflect.DeepEqual(uids, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.args, test.expected, uids)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	td := testutil.NewDatabase(t)
+	defer td.Close()
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.createFolder(t, "Drafts")
+
+	mailbox := ts.mailbox()
+	mailbox.FolderOptions = map[string]FolderOptions{"Drafts": {Upload: true}}
+	h := newTestHandler(t, td.DB, td.Path, mailbox)
+	defer h.Close()
+
+	message := func(messageID string) string {
+		return "From: sender@example.org\r\n" +
+			"Subject: Draft\r\n" +
+			"Message-ID: <" + messageID + ">\r\n" +
+			"\r\n" +
+			"Hello\r\n"
+	}
+	files := map[string]string{
+		filepath.Join("Drafts", "cur", "1:2,S"): message("draft@example.org"),
+		filepath.Join("Drafts", "cur", "2:2,"):  "not a message",
+		filepath.Join("Drafts", "cur", "3:2,"):  message("partial@example.org"),
+		// Uploading isn't enabled for INBOX
+		filepath.Join("INBOX", "cur", "4:2,"): message("inbox@example.org"),
+	}
+	for name, contents := range files {
+		path := filepath.Join(h.maildirPath, name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the headers of this message have been downloaded
+	td.DB.Lock()
+	m, st := td.DB.AddMessage(filepath.Join(h.maildirPath, "Drafts", "cur", "3:2,"))
+	if st != notmuch.STATUS_SUCCESS {
+		t.Fatal(st)
+	}
+	m.AddTag(tagnames.Partial)
+	m.Destroy()
+	td.DB.Unlock()
+
+	// The invalid and partial messages don't keep the draft from being uploaded
+	err := h.CheckMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for folder, expected := range map[string]uint32{"Drafts": 1, "INBOX": 1} {
+		mbox, err := ts.user.GetMailbox(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != expected {
+			t.Errorf("expected %d messages in %s on the server, got %d", expected, folder, status.Messages)
+		}
+	}
+	if td.Tags("draft@example.org") == nil {
+		t.Errorf("uploaded message not indexed")
+	}
+}
@@ -0,0 +1,151 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
+)
+
+// uidRegexp matches the UID field of filenames created by getMessage
+var uidRegexp = regexp.MustCompile(`,U=[0-9]+`)
+
+// setFilenameUID returns 'filename' with the UID field set to 'uid'
+func setFilenameUID(filename string, uid uint32) string {
+	field := fmt.Sprintf(",U=%d", uid)
+	if uidRegexp.MatchString(filename) {
+		return uidRegexp.ReplaceAllLiteralString(filename, field)
+	}
+
+	// Keep the maildir info suffix last
+	if idx := strings.Index(filename, ":2,"); idx >= 0 {
+		return filename[:idx] + field + filename[idx:]
+	}
+	return filename + field
+}
+
+// maildirFlags maps IMAP flags to maildir info flags
+var maildirFlags = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+// maildirInfo returns the maildir info suffix for a message with a specific set of IMAP flags, e.g. ":2,FS"
+func maildirInfo(flags []string) string {
+	canonical := make([]string, len(flags))
+	for i, flag := range flags {
+		canonical[i] = imap.CanonicalFlag(flag)
+	}
+	return source.MaildirInfo(canonical, maildirFlags)
+}
+
+// localMessageFiles returns the paths of all messages stored locally in a mailbox
+func (h *Handler) localMessageFiles(mailbox string) ([]string, error) {
+	var files []string
+	for _, subdir := range []string{"cur", "new"} {
+		dirPath := filepath.Join(h.folderPath(mailbox), subdir)
+		entries, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(dirPath, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// localMessageIDs returns a map from message id to path for all messages stored locally in a mailbox
+func (h *Handler) localMessageIDs(mailbox string) (map[string]string, error) {
+	files, err := h.localMessageFiles(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(files))
+	for _, path := range files {
+		messageID, err := readMessageID(path)
+		if err != nil || messageID == "" {
+			continue
+		}
+		result[messageID] = path
+	}
+	return result, nil
+}
+
+// readMessageID reads the Message-ID header from a message file
+func readMessageID(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	msg, err := mail.ReadMessage(bufio.NewReader(fd))
+	if err != nil {
+		return "", err
+	}
+	return normalizeMessageID(msg.Header.Get("Message-Id")), nil
+}
+
+// updateFileUID sets a new UID in the filename of a message
+func (h *Handler) updateFileUID(path string, uid uint32) error {
+	newPath := filepath.Join(filepath.Dir(path), setFilenameUID(filepath.Base(path), uid))
+
+	h.db.Lock()
+	defer h.db.Unlock()
+	return h.renameMessageFile(path, newPath)
+}
+
+// renameMessageFile moves a message file, and updates the filename in the index.
+// Tags are kept, since the message id doesn't change.
+// Note that the caller must hold the database lock.
+func (h *Handler) renameMessageFile(oldPath, newPath string) error {
+	if oldPath == newPath {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(newPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(oldPath, newPath)
+	if err != nil {
+		return err
+	}
+
+	// Adding the new filename first makes sure that the message is never removed from the index
+	m, st := h.db.AddMessage(newPath)
+	if m != nil {
+		m.Destroy()
+	}
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return errors.New(st.String())
+	}
+
+	st = h.db.RemoveMessage(oldPath)
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return errors.New(st.String())
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package imap
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// moveCommand is a MOVE command, as defined in RFC 6851. It takes the same arguments as COPY
+type moveCommand struct {
+	commands.Copy
+}
+
+func (cmd *moveCommand) Command() *imap.Command {
+	c := cmd.Copy.Command()
+	c.Name = "MOVE"
+	return c
+}
+
+// uidExpungeCommand is a UID EXPUNGE command, as defined in RFC 4315
+type uidExpungeCommand struct {
+	seqSet *imap.SeqSet
+}
+
+func (cmd *uidExpungeCommand) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "UID",
+		Arguments: []interface{}{imap.RawString("EXPUNGE"), cmd.seqSet},
+	}
+}
+
+// copyUIDResponse handles the untagged COPYUID response codes sent by MOVE
+type copyUIDResponse struct {
+	statuses []*imap.StatusResp
+}
+
+func (r *copyUIDResponse) Handle(resp imap.Resp) error {
+	if status, ok := resp.(*imap.StatusResp); ok && status.Tag == "*" && status.Code == "COPYUID" {
+		r.statuses = append(r.statuses, status)
+		return nil
+	}
+	return responses.ErrUnhandled
+}
+
+// copiedUIDs adds the new UIDs of copied or moved messages from a COPYUID response code (RFC 4315)
+// to uids, by their old UIDs. Nothing is added if the server didn't send a valid response code.
+func copiedUIDs(status *imap.StatusResp, uids map[uint32]uint32) {
+	if status == nil || status.Code != "COPYUID" || len(status.Arguments) < 3 {
+		return
+	}
+	oldUIDs := parseUIDSet(status.Arguments[1])
+	newUIDs := parseUIDSet(status.Arguments[2])
+	if len(oldUIDs) == 0 || len(oldUIDs) != len(newUIDs) {
+		return
+	}
+	for i := range oldUIDs {
+		uids[oldUIDs[i]] = newUIDs[i]
+	}
+}
+
+// parseUIDSet returns the UIDs in a uid-set (e.g. "4,7:9") of a COPYUID response code, in order.
+// Unlike imap.ParseSeqSet, the order is kept, since the old and new UIDs are matched by their position.
+func parseUIDSet(arg interface{}) []uint32 {
+	var uids []uint32
+	// Single numbers are parsed as numbers, and sets as atoms
+	for _, part := range strings.Split(fmt.Sprint(arg), ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return nil
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 32)
+			if err != nil {
+				return nil
+			}
+		}
+
+		step := 1
+		if last < first {
+			step = -1
+		}
+		for uid := int64(first); ; uid += int64(step) {
+			uids = append(uids, uint32(uid))
+			if uid == int64(last) {
+				break
+			}
+		}
+	}
+	return uids
+}
+
+// moveUIDs moves messages in the currently selected mailbox to another mailbox on the server with
+// a single command, and returns their new UIDs by their old ones, if the server tells us what they are
+func moveUIDs(c *client.Client, uids []uint32, target string) (map[uint32]uint32, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	newUIDs := make(map[uint32]uint32)
+
+	supportsMove, err := c.Support("MOVE")
+	if err != nil {
+		return nil, err
+	}
+	if supportsMove {
+		res := &copyUIDResponse{}
+		status, err := c.Execute(&commands.Uid{Cmd: &moveCommand{commands.Copy{SeqSet: seqSet, Mailbox: target}}}, res)
+		if err != nil {
+			return nil, err
+		}
+		if err = status.Err(); err != nil {
+			return nil, err
+		}
+		for _, status := range res.statuses {
+			copiedUIDs(status, newUIDs)
+		}
+		return newUIDs, nil
+	}
+
+	// Fall back to COPY, followed by marking the originals as deleted and expunging them
+	status, err := c.Execute(&commands.Uid{Cmd: &commands.Copy{SeqSet: seqSet, Mailbox: target}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = status.Err(); err != nil {
+		return nil, err
+	}
+	copiedUIDs(status, newUIDs)
+
+	err = c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// With UIDPLUS, we can avoid expunging other messages marked as deleted
+	uidPlus, err := c.Support("UIDPLUS")
+	if err != nil {
+		return nil, err
+	}
+	if uidPlus {
+		status, err = c.Execute(&uidExpungeCommand{seqSet: seqSet}, nil)
+		if err == nil {
+			err = status.Err()
+		}
+	} else {
+		err = c.Expunge(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newUIDs, nil
+}
+
+// messageLocations returns the mailboxes and UIDs of all copies of a message on the server
+func (h *Handler) messageLocations(messageID string) map[string]uint32 {
+	locations := make(map[string]uint32)
+	found, _ := h.locateMessages([]string{messageID})
+	for mailbox, uids := range found {
+		locations[mailbox] = uids[0]
+	}
+	return locations
+}
+
+// locateMessages returns the UIDs of all copies of a set of messages on the server by mailbox,
+// and the set of messages which were found
+func (h *Handler) locateMessages(messageIDs []string) (map[string][]uint32, map[string]bool) {
+	wanted := make(map[string]bool, len(messageIDs))
+	for _, messageID := range messageIDs {
+		wanted[normalizeMessageID(messageID)] = true
+	}
+
+	locations := make(map[string][]uint32)
+	found := make(map[string]bool)
+	h.mu.Lock()
+	for mailbox, messages := range h.cfg.Messages {
+		for uid, state := range messages {
+			if wanted[state.MessageID] {
+				locations[mailbox] = append(locations[mailbox], uid)
+				found[state.MessageID] = true
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	// Messages downloaded before we kept track of message ids are found by their filename
+	for messageID := range wanted {
+		if found[messageID] {
+			continue
+		}
+		if mailbox, uid, ok := h.fileLocation(messageID); ok {
+			locations[mailbox] = append(locations[mailbox], uid)
+			found[messageID] = true
+		}
+	}
+
+	for _, uids := range locations {
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	}
+	return locations, found
+}
+
+// fileLocation returns the mailbox and UID of a message, based on the name of its local file
+func (h *Handler) fileLocation(messageID string) (string, uint32, bool) {
+	h.db.Lock()
+	m, _ := h.db.FindMessage(messageID)
+	var path string
+	if m != nil {
+		path = m.GetFileName()
+		m.Destroy()
+	}
+	h.db.Unlock()
+
+	rel, err := filepath.Rel(h.maildirPath, path)
+	if path == "" || err != nil || strings.HasPrefix(rel, "..") {
+		return "", 0, false
+	}
+
+	field := uidRegexp.FindString(filepath.Base(path))
+	if field == "" {
+		return "", 0, false
+	}
+	uid, err := strconv.ParseUint(field[len(",U="):], 10, 32)
+	if err != nil {
+		return "", 0, false
+	}
+
+	// Strip cur/ or new/ from the path
+	return h.remoteFolder(filepath.Dir(filepath.Dir(rel))), uint32(uid), true
+}
+
+// Move moves messages to another folder on the server, and moves the local files to the matching
+// folder in the maildir. All messages are moved over a single connection. It returns the ids of
+// the messages which are stored on this server.
+func (h *Handler) Move(messageIDs []string, folder string) ([]string, error) {
+	locations, stored := h.locateMessages(messageIDs)
+	var found []string
+	for _, messageID := range messageIDs {
+		if stored[normalizeMessageID(messageID)] {
+			found = append(found, messageID)
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	c, err := h.connect()
+	if err != nil {
+		return found, err
+	}
+	defer c.Logout()
+
+	mailboxes := make([]string, 0, len(locations))
+	for mailbox := range locations {
+		mailboxes = append(mailboxes, mailbox)
+	}
+	sort.Strings(mailboxes)
+
+	for _, mailbox := range mailboxes {
+		if mailbox == folder {
+			continue
+		}
+
+		err = h.moveMessages(c, mailbox, locations[mailbox], folder)
+		if err != nil {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+// moveMessages moves messages from one folder to another, both on the server and locally.
+// The messages are moved on the server with a single command.
+func (h *Handler) moveMessages(c *client.Client, mailbox string, uids []uint32, target string) error {
+	_, err := c.Select(mailbox, false)
+	if err != nil {
+		return err
+	}
+
+	local, err := h.localUIDs(mailbox)
+	if err != nil {
+		return err
+	}
+
+	newUIDs, err := moveUIDs(c, uids, target)
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range uids {
+		newUID := newUIDs[uid]
+
+		// If we don't know the new UID, the local file is moved by syncDeletions
+		// once the message has been found in the target folder
+		if newUID == 0 {
+			fmt.Fprintf(h.out, " moved UID %d from %s to %s on server\n", uid, mailbox, target)
+			continue
+		}
+
+		state := h.getMessageState(mailbox, uid)
+		if path, ok := local[uid]; ok {
+			newPath := filepath.Join(h.folderPath(target), "cur", setFilenameUID(filepath.Base(path), newUID))
+			fmt.Fprintf(h.out, " moving %s from %s to %s\n", filepath.Base(path), mailbox, target)
+
+			h.db.Lock()
+			err = h.renameMessageFile(path, newPath)
+			h.db.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+
+		h.deleteMessageState(mailbox, uid)
+		if state != nil {
+			h.setMessageState(target, newUID, state)
+		}
+	}
+	return nil
+}
+
+// moveTagged moves messages in the folder selected by selectFolder which have been tagged
+// with one of the tags in TagFolders to the corresponding folder. Messages which are already
+// in the folder of one of their tags are left alone, and messages with several of the tags are
+// moved to the folder of the first tag in alphabetical order, so that they're never moved back
+// and forth between folders.
+func (h *Handler) moveTagged(c *client.Client, fs *folderSync) error {
+	if len(h.mailbox.TagFolders) == 0 {
+		return nil
+	}
+
+	folderPath, err := filepath.Rel(h.db.GetPath(), h.folderPath(fs.mailbox))
+	if err != nil {
+		return err
+	}
+
+	tags := make([]string, 0, len(h.mailbox.TagFolders))
+	for tag := range h.mailbox.TagFolders {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	targets := make(map[string]string) // Target folder by message id
+	for _, tag := range tags {
+		target := h.mailbox.TagFolders[tag]
+
+		queryStr := fmt.Sprintf("tag:\"%s\" and folder:\"%s\"",
+			strings.Replace(tag, "\"", "\\\"", -1),
+			strings.Replace(folderPath, "\"", "\\\"", -1))
+
+		h.db.Lock()
+		q := h.db.CreateQuery(queryStr)
+		messages := q.SearchMessages()
+		for messages != nil && messages.Valid() {
+			m := messages.Get()
+			messageID := m.GetMessageId()
+			// The first tag decides where the message goes, unless it's already in the folder of one of its tags
+			if _, ok := targets[messageID]; !ok || target == fs.mailbox {
+				targets[messageID] = target
+			}
+			m.Destroy()
+			messages.MoveToNext()
+		}
+		q.Destroy()
+		h.db.Unlock()
+
+		if messages == nil {
+			return fmt.Errorf("could not search for messages tagged %s", tag)
+		}
+	}
+
+	byTarget := make(map[string][]string)
+	for messageID, target := range targets {
+		if target != fs.mailbox {
+			byTarget[target] = append(byTarget[target], messageID)
+		}
+	}
+	targetNames := make([]string, 0, len(byTarget))
+	for target := range byTarget {
+		targetNames = append(targetNames, target)
+	}
+	sort.Strings(targetNames)
+
+	for _, target := range targetNames {
+		locations, _ := h.locateMessages(byTarget[target])
+		uids := locations[fs.mailbox]
+		if len(uids) == 0 {
+			continue
+		}
+		err = h.moveMessages(c, fs.mailbox, uids, target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package imap
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/yzzyx/mr/internal/tagnames"
+	"github.com/yzzyx/mr/notmuch"
+)
+
+var md5Regexp = regexp.MustCompile(`,FMD5=[0-9a-f]+`)
+
+// FolderOptions limits which messages are downloaded from a folder, and whether local messages are uploaded
+type FolderOptions struct {
+	// Only download messages newer than this number of days
+	MaxAge int `yaml:"max_age"`
+	// Only download the headers of messages larger than this number of megabytes
+	MaxSize int `yaml:"max_size"`
+	// Only download the headers of messages, the body is downloaded when the message is opened
+	HeadersOnly bool `yaml:"headers_only"`
+	// Upload messages that have been added to the local maildir of the folder to the server,
+	// even if Upload isn't set for the account
+	Upload bool
+}
+
+// folderOptions returns the options set for a folder, either by its name or by a glob pattern
+func (h *Handler) folderOptions(mailbox string) FolderOptions {
+	if opts, ok := h.mailbox.FolderOptions[mailbox]; ok {
+		return opts
+	}
+
+	patterns := make([]string, 0, len(h.mailbox.FolderOptions))
+	for pattern := range h.mailbox.FolderOptions {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if matchFolder(pattern, mailbox) {
+			return h.mailbox.FolderOptions[pattern]
+		}
+	}
+	return FolderOptions{}
+}
+
+// headersOnly returns true if only the headers of a message of the specified size should be downloaded
+func (opts FolderOptions) headersOnly(size uint32) bool {
+	return opts.HeadersOnly || (opts.MaxSize > 0 && int64(size) > int64(opts.MaxSize)*1024*1024)
+}
+
+// searchSince returns the UIDs in seqSet of messages which are newer than maxAge days
+func searchSince(c *client.Client, seqSet *imap.SeqSet, maxAge int) (*imap.SeqSet, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = seqSet
+	criteria.Since = time.Now().AddDate(0, 0, -maxAge)
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(imap.SeqSet)
+	result.AddNum(uids...)
+	return result, nil
+}
+
+// FetchBody downloads the full message of a message where only the headers have been downloaded,
+// and returns the path of the updated file. An empty path is returned if the message isn't
+// stored on this server.
+func (h *Handler) FetchBody(messageID string) (string, error) {
+	messageID = normalizeMessageID(messageID)
+	for mailbox, uid := range h.messageLocations(messageID) {
+		local, err := h.localUIDs(mailbox)
+		if err != nil {
+			return "", err
+		}
+		path, ok := local[uid]
+		if !ok {
+			continue
+		}
+
+		c, err := h.connectMailbox(mailbox)
+		if err != nil {
+			return "", err
+		}
+		defer c.Logout()
+
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+		section := &imap.BodySectionName{Peek: true}
+		found := false
+		err = uidFetch(c, seqSet, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, func(msg *imap.Message) error {
+			r := msg.GetBody(section)
+			if r == nil {
+				return fmt.Errorf("server didn't return body of message %d in %s", msg.Uid, mailbox)
+			}
+			found = true
+			path, err = h.replaceMessageFile(path, messageID, r)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", fmt.Errorf("message %s not found in %s", messageID, mailbox)
+		}
+
+		state := h.getMessageState(mailbox, uid)
+		if state != nil {
+			state.Partial = false
+			h.setMessageState(mailbox, uid, state)
+		}
+		return path, nil
+	}
+	return "", nil
+}
+
+// replaceMessageFile replaces the contents of a message file with the full message, and indexes it.
+// The tags of the message are kept, except for the partial tag.
+func (h *Handler) replaceMessageFile(path string, messageID string, r io.Reader) (string, error) {
+	tmpPath := filepath.Join(filepath.Dir(filepath.Dir(path)), "tmp", filepath.Base(path))
+	err := os.MkdirAll(filepath.Dir(tmpPath), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	newName := md5Regexp.ReplaceAllString(filepath.Base(path), fmt.Sprintf(",FMD5=%x", md5.Sum(data)))
+	newPath := filepath.Join(filepath.Dir(path), newName)
+
+	err = os.Rename(tmpPath, newPath)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	h.db.Lock()
+	defer h.db.Unlock()
+
+	// The new file is added before the old one is removed, so that the message is never
+	// removed from the index, and the old file is kept until the new one has been indexed.
+	// The body of the new file is indexed as an additional file of the same message.
+	m, st := h.db.AddMessage(newPath)
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		if m != nil {
+			m.Destroy()
+		}
+		if newPath != path {
+			_ = os.Remove(newPath)
+		}
+		return "", errors.New(st.String())
+	}
+	m.RemoveTag(tagnames.Partial)
+	m.Destroy()
+
+	if newPath != path {
+		st = h.db.RemoveMessage(path)
+		if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+			return "", errors.New(st.String())
+		}
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return newPath, nil
+}
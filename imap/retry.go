@@ -0,0 +1,84 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// Number of times a failed operation is retried, after reconnecting to the server
+const maxRetries = 3
+
+// connectionClosed returns true if the connection to the server has been lost
+func connectionClosed(c *client.Client) bool {
+	select {
+	case <-c.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
+// errClosed is returned by operations which are interrupted because the handler is closed
+var errClosed = errors.New("handler closed")
+
+// closed returns true if the handler has been closed
+func (h *Handler) closed() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// session is a connection used during a synchronization pass, which is opened again if it's lost
+type session struct {
+	h *Handler
+	c *client.Client
+}
+
+// run calls fn with an open connection. If the connection is lost, or can't be opened,
+// fn is called again with a new connection after an increasing delay.
+func (s *session) run(fn func(c *client.Client) error) error {
+	delay := minReconnectDelay
+	for attempt := 0; ; attempt++ {
+		var err error
+		if s.c == nil {
+			s.c, err = s.h.connect()
+		}
+		if err == nil {
+			err = fn(s.c)
+			if err == nil || !connectionClosed(s.c) {
+				return err
+			}
+			s.c = nil
+		}
+
+		if attempt >= maxRetries {
+			return err
+		}
+		fmt.Fprintf(s.h.out, "connection failed: %s, reconnecting in %s\n", err, delay)
+
+		select {
+		case <-s.h.done:
+			return errClosed
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// close logs out from the server
+func (s *session) close() {
+	if s.c != nil {
+		_ = s.c.Logout()
+		s.c = nil
+	}
+}
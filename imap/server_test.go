@@ -0,0 +1,215 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/yzzyx/mr/notmuch"
+)
+
+// Message id of the message in INBOX of the memory backend
+const defaultMessageID = "0000000@localhost/"
+
+// testServer is an in-process IMAP server, using the memory backend of go-imap.
+// The memory backend has a single user "username" with password "password",
+// and uses "/" as hierarchy delimiter.
+type testServer struct {
+	server   *server.Server
+	listener net.Listener
+	user     backend.User
+	backend  *failingBackend
+}
+
+func newTestServer(t *testing.T) *testServer {
+	be := &failingBackend{Backend: memory.New()}
+	user, err := be.Backend.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go s.Serve(l)
+
+	return &testServer{server: s, listener: l, user: user, backend: be}
+}
+
+func (ts *testServer) Close() {
+	_ = ts.server.Close()
+}
+
+// failBody makes the server refuse to return the body of the message with the specified UID.
+// A UID of 0 makes all bodies available again.
+func (ts *testServer) failBody(uid uint32) {
+	ts.backend.mu.Lock()
+	ts.backend.failUID = uid
+	ts.backend.mu.Unlock()
+}
+
+// mailbox returns a configuration which connects to the server
+func (ts *testServer) mailbox() Mailbox {
+	addr := ts.listener.Addr().(*net.TCPAddr)
+	return Mailbox{
+		Server:   addr.IP.String(),
+		Port:     addr.Port,
+		Username: "username",
+		Password: "password",
+	}
+}
+
+// createFolder creates a folder on the server
+func (ts *testServer) createFolder(t *testing.T, folder string) {
+	err := ts.user.CreateMailbox(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addMessage adds a message to a folder, which is created if it doesn't exist
+func (ts *testServer) addMessage(t *testing.T, folder string, messageID string, flags ...string) {
+	mbox, err := ts.user.GetMailbox(folder)
+	if err != nil {
+		ts.createFolder(t, folder)
+		mbox, err = ts.user.GetMailbox(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := "From: sender@example.org\r\n" +
+		"To: recipient@example.org\r\n" +
+		"Subject: Message " + messageID + "\r\n" +
+		"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+		"Message-ID: <" + messageID + ">\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+	err = mbox.CreateMessage(flags, time.Now(), bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestHandler creates a handler storing messages in a subdirectory of 'path'.
+// db may be nil for tests which don't download messages.
+func newTestHandler(t *testing.T, db *notmuch.Database, path string, mailbox Mailbox) *Handler {
+	h, err := New(db, filepath.Join(path, "test"), mailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetOutput(ioutil.Discard)
+	return h
+}
+
+// countFiles returns the number of messages stored in the maildir of a handler
+func countFiles(t *testing.T, h *Handler, folder string) int {
+	files, err := h.localMessageFiles(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+// unusedAddr returns an address where nothing is listening
+func unusedAddr(t *testing.T) (string, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, p
+}
+
+// blockFolder makes it impossible to store messages in a folder, by creating a file where its maildir should be
+func blockFolder(t *testing.T, h *Handler, folder string) {
+	path := h.folderPath(folder)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingBackend wraps the memory backend, and fails commands which fetch the body
+// of a specific message, in order to interrupt downloads
+type failingBackend struct {
+	backend.Backend
+
+	mu      sync.Mutex
+	failUID uint32
+}
+
+func (be *failingBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &failingUser{User: user, be: be}, nil
+}
+
+type failingUser struct {
+	backend.User
+	be *failingBackend
+}
+
+func (u *failingUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingMailbox{Mailbox: mbox, be: u.be}, nil
+}
+
+type failingMailbox struct {
+	backend.Mailbox
+	be *failingBackend
+}
+
+func (mbox *failingMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	mbox.be.mu.Lock()
+	failUID := mbox.be.failUID
+	mbox.be.mu.Unlock()
+
+	if uid && failUID != 0 && seqSet.Contains(failUID) {
+		for _, item := range items {
+			if strings.HasPrefix(string(item), "BODY") {
+				close(ch)
+				return errors.New("message body unavailable")
+			}
+		}
+	}
+	return mbox.Mailbox.ListMessages(uid, seqSet, items, ch)
+}
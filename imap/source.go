@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap/client"
+	"github.com/yzzyx/mr/config"
+	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
+)
+
+func init() {
+	source.Register("imap", newSource)
+}
+
+// newSource creates a handler from the configuration of an account
+func newSource(db *notmuch.Database, path string, account *config.Account) (source.MailSource, error) {
+	var mailbox Mailbox
+	err := account.Decode(&mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range []*string{&mailbox.PasswordFile, &mailbox.TLS.CAFile, &mailbox.TLS.CertFile, &mailbox.TLS.KeyFile} {
+		if *p != "" {
+			*p = config.ExpandPath(*p)
+		}
+	}
+	return New(db, path, mailbox)
+}
+
+// Connect opens the connection used for a synchronization pass.
+// The connection is opened again if it's lost during the pass.
+func (h *Handler) Connect() error {
+	h.session = &session{h: h}
+	return h.session.run(func(c *client.Client) error { return nil })
+}
+
+// Disconnect logs out from the server at the end of a synchronization pass
+func (h *Handler) Disconnect() {
+	if h.session != nil {
+		h.session.close()
+		h.session = nil
+	}
+}
+
+// ListFolders returns the folders on the server which should be synchronized
+func (h *Handler) ListFolders() ([]string, error) {
+	var folders []string
+	err := h.session.run(func(c *client.Client) error {
+		var err error
+		folders, err = h.listFolders(c)
+		return err
+	})
+	return folders, err
+}
+
+// FetchNew downloads new messages from a folder
+func (h *Handler) FetchNew(folder string) error {
+	err := h.session.run(func(c *client.Client) error {
+		fs, err := h.selectFolder(c, folder)
+		if err != nil {
+			return err
+		}
+		return h.mailboxFetchMessages(c, fs)
+	})
+	h.checkpoint()
+	return err
+}
+
+// PushChanges synchronizes flags, uploads and moves messages, and removes messages
+// which have been deleted on the server from a folder
+func (h *Handler) PushChanges(folder string) error {
+	err := h.session.run(func(c *client.Client) error {
+		fs, err := h.selectFolder(c, folder)
+		if err != nil {
+			return err
+		}
+		return h.pushChanges(c, fs)
+	})
+	h.checkpoint()
+	return err
+}
+
+// Watching returns true if the handler should keep watching folders in the background
+func (h *Handler) Watching() bool {
+	return h.mailbox.Idle
+}
+
+// CheckMessages performs a full synchronization pass of all folders
+func (h *Handler) CheckMessages() error {
+	return source.Sync(h)
+}
@@ -0,0 +1,110 @@
+package imap
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/yzzyx/mr/source"
+)
+
+// Version of the format of the state file.
+// Version 0 is the unversioned format, which is otherwise the same as version 1.
+const stateVersion = 1
+
+// Files in the maildir of a handler
+const (
+	stateFilename = ".imap-uids"
+	lockFilename  = ".imap-uids.lock"
+)
+
+// ErrLocked is returned by New if another process is synchronizing the same mailbox
+var ErrLocked = source.ErrLocked
+
+// stateMigrations converts the state from one version to the next.
+// The function at index i converts from version i to version i+1.
+var stateMigrations = []func(cfg *mailConfig){
+	// Version 0 to 1: only the version number was added
+	func(cfg *mailConfig) {},
+}
+
+// loadState reads the synchronization state of the handler, and upgrades it to the current version
+func (h *Handler) loadState() error {
+	h.cfg.LastSeenUID = make(map[string]uint32)
+	h.cfg.UIDValidity = make(map[string]uint32)
+	h.cfg.Messages = make(map[string]map[uint32]*messageState)
+	h.cfg.HighestModSeq = make(map[string]uint64)
+
+	path := filepath.Join(h.maildirPath, stateFilename)
+	found, err := source.LoadState(path, &h.cfg)
+	if err != nil {
+		return err
+	}
+	if !found {
+		h.cfg.Version = stateVersion
+		return nil
+	}
+	err = source.CheckStateVersion(path, h.cfg.Version, stateVersion)
+	if err != nil {
+		return err
+	}
+	for h.cfg.Version < stateVersion {
+		stateMigrations[h.cfg.Version](&h.cfg)
+		h.cfg.Version++
+	}
+
+	// Fields may be missing in files written by earlier versions
+	if h.cfg.LastSeenUID == nil {
+		h.cfg.LastSeenUID = make(map[string]uint32)
+	}
+	if h.cfg.UIDValidity == nil {
+		h.cfg.UIDValidity = make(map[string]uint32)
+	}
+	if h.cfg.Messages == nil {
+		h.cfg.Messages = make(map[string]map[uint32]*messageState)
+	}
+	if h.cfg.HighestModSeq == nil {
+		h.cfg.HighestModSeq = make(map[string]uint64)
+	}
+	return nil
+}
+
+// saveState writes the synchronization state of the handler
+func (h *Handler) saveState() error {
+	h.mu.Lock()
+	data, err := json.Marshal(h.cfg)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+	return source.WriteFileAtomic(filepath.Join(h.maildirPath, stateFilename), data)
+}
+
+// checkpoint saves the synchronization state while synchronizing
+func (h *Handler) checkpoint() {
+	source.Checkpoint(h.out, h.saveState)
+}
+
+func (h *Handler) lockPath() string {
+	return filepath.Join(h.maildirPath, lockFilename)
+}
+
+// lockState takes an exclusive lock on the lock file of the handler,
+// which is released when the process exits, or by unlockState
+func (h *Handler) lockState() error {
+	fd, err := source.LockFile(h.lockPath())
+	if err != nil {
+		return err
+	}
+	h.lockFile = fd
+	return nil
+}
+
+func (h *Handler) unlockState() {
+	if h.lockFile != nil {
+		source.UnlockFile(h.lockFile)
+		h.lockFile = nil
+	}
+}
@@ -0,0 +1,43 @@
+package imap
+
+import (
+	"net"
+	"time"
+
+	"github.com/yzzyx/mr/source"
+)
+
+// timeoutDialer opens connections with a connect timeout, and wraps them in a source.TimeoutConn.
+//
+// The Timeout of the go-imap client can't be used for this, since it sets a deadline for the
+// whole connection when a command is sent: long downloads would fail, and so would idle
+// connections that are waiting for the next command.
+type timeoutDialer struct {
+	net.Dialer
+	timeout time.Duration
+
+	// The last connection that was opened
+	conn *source.TimeoutConn
+}
+
+func (d *timeoutDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.conn = source.NewTimeoutConn(conn, d.timeout)
+	return d.conn, nil
+}
+
+// newDialer returns a dialer using the timeouts in the configuration
+func (h *Handler) newDialer() *timeoutDialer {
+	d := &timeoutDialer{timeout: source.DefaultTimeout}
+	d.Dialer.Timeout = source.DefaultConnectTimeout
+	if h.mailbox.ConnectTimeout > 0 {
+		d.Dialer.Timeout = time.Duration(h.mailbox.ConnectTimeout) * time.Second
+	}
+	if h.mailbox.Timeout > 0 {
+		d.timeout = time.Duration(h.mailbox.Timeout) * time.Second
+	}
+	return d
+}
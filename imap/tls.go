@@ -0,0 +1,92 @@
+package imap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLSConfig defines the TLS settings used when connecting to a server
+type TLSConfig struct {
+	// File containing PEM encoded CA certificates used to verify the server, instead of the system CAs
+	CAFile string `yaml:"ca_file"`
+
+	// Client certificate and key, in PEM format
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// Minimum TLS version, one of "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string `yaml:"min_version"`
+
+	// SHA-256 fingerprint of the server certificate, in hex (colons are optional).
+	// If set, the server certificate is only accepted if it matches, and the CA isn't checked.
+	Fingerprint string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS configuration used for both TLS and STARTTLS connections
+func (h *Handler) tlsConfig() (*tls.Config, error) {
+	opts := h.mailbox.TLS
+	config := &tls.Config{ServerName: h.mailbox.Server}
+
+	if opts.CAFile != "" {
+		data, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.MinVersion != "" {
+		version, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %s", opts.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if opts.Fingerprint != "" {
+		fingerprint, err := hex.DecodeString(strings.Replace(opts.Fingerprint, ":", "", -1))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 fingerprint %s", opts.Fingerprint)
+		}
+
+		// The certificate is verified by its fingerprint instead of by the CA
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server didn't send a certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], fingerprint) {
+				return fmt.Errorf("server certificate fingerprint %x doesn't match the configured fingerprint", sum)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,184 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/yzzyx/mr/internal/tagnames"
+	"github.com/yzzyx/mr/source"
+)
+
+// filenameFlags returns the IMAP flags matching the maildir info suffix of a filename
+func filenameFlags(filename string) []string {
+	idx := strings.LastIndex(filename, ":2,")
+	if idx < 0 {
+		return nil
+	}
+
+	var flags []string
+	for _, f := range []byte(filename[idx+len(":2,"):]) {
+		for flag, mf := range maildirFlags {
+			if f == mf {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return flags
+}
+
+// uploadMessages uploads messages that have been added to the local maildir of a folder
+// (e.g. drafts or sent mail) to the server, using the folder selected by selectFolder.
+// Once a message has been uploaded, its UID is added to the filename, so that it's
+// neither uploaded nor downloaded again. Uploading is only done if it's enabled for the
+// account or the folder, and messages where only the headers have been downloaded are
+// never uploaded. A message which can't be uploaded doesn't stop the other ones.
+func (h *Handler) uploadMessages(c *client.Client, fs *folderSync) error {
+	if !h.mailbox.Upload && !h.folderOptions(fs.mailbox).Upload {
+		return nil
+	}
+
+	files, err := h.localMessageFiles(fs.mailbox)
+	if err != nil {
+		return err
+	}
+
+	uidPlus, err := c.Support("UIDPLUS")
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		if uidRegexp.MatchString(filepath.Base(path)) {
+			continue
+		}
+
+		messageID, err := readMessageID(path)
+		if err != nil {
+			fmt.Fprintf(h.out, " not uploading %s to %s: %s\n", filepath.Base(path), fs.mailbox, err)
+			continue
+		}
+
+		// Without UIDPLUS, the uploaded message has to be found by its message id
+		if messageID == "" && !uidPlus {
+			fmt.Fprintf(h.out, " not uploading %s to %s, since it has no message id\n", filepath.Base(path), fs.mailbox)
+			continue
+		}
+
+		if messageID != "" && h.partialMessage(messageID) {
+			fmt.Fprintf(h.out, " not uploading %s to %s, since only its headers have been downloaded\n", filepath.Base(path), fs.mailbox)
+			continue
+		}
+
+		err = h.uploadMessage(c, fs, path, messageID)
+		if err != nil {
+			// Other messages can't be uploaded either if the connection has been lost
+			if connectionClosed(c) {
+				return err
+			}
+			fmt.Fprintf(h.out, " could not upload %s to %s: %s\n", filepath.Base(path), fs.mailbox, err)
+		}
+	}
+	return nil
+}
+
+// partialMessage returns true if only the headers of a message have been downloaded
+func (h *Handler) partialMessage(messageID string) bool {
+	h.db.Lock()
+	defer h.db.Unlock()
+	tags, _ := source.LocalTags(h.db, messageID)
+	return tags[tagnames.Partial]
+}
+
+// uploadMessage uploads a single message to the server with APPEND, and adds the new UID to its filename
+func (h *Handler) uploadMessage(c *client.Client, fs *folderSync, path string, messageID string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	flags := filenameFlags(filepath.Base(path))
+	cmd := &commands.Append{
+		Mailbox: fs.mailbox,
+		Flags:   flags,
+		Date:    info.ModTime(),
+		Message: bytes.NewBuffer(data),
+	}
+	status, err := c.Execute(cmd, nil)
+	if err != nil {
+		return err
+	}
+	if err = status.Err(); err != nil {
+		return err
+	}
+
+	uid, err := appendedUID(c, fs, status, messageID)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return fmt.Errorf("could not find UID of message %s uploaded to %s", filepath.Base(path), fs.mailbox)
+	}
+	fmt.Fprintf(h.out, " uploaded %s to %s with UID %d\n", filepath.Base(path), fs.mailbox, uid)
+
+	state := &messageState{MessageID: messageID}
+	if h.mailbox.SyncFlags {
+		state.Flags = h.mappedFlags(flags)
+	}
+	h.setMessageState(fs.mailbox, uid, state)
+
+	// This also adds the message to the index, so that it's not downloaded again
+	return h.updateFileUID(path, uid)
+}
+
+// appendedUID returns the UID of a message uploaded with APPEND.
+// If the server supports UIDPLUS (RFC 4315), it's included in the response,
+// otherwise we have to search for the message id in the selected folder.
+// If no message was found, 0 is returned.
+func appendedUID(c *client.Client, fs *folderSync, status *imap.StatusResp, messageID string) (uint32, error) {
+	if status.Code == "APPENDUID" && len(status.Arguments) >= 2 {
+		uidValidity, err := imap.ParseNumber(status.Arguments[0])
+		if err != nil {
+			return 0, err
+		}
+		uid, err := imap.ParseNumber(status.Arguments[1])
+		if err != nil {
+			return 0, err
+		}
+
+		if uidValidity == fs.status.UidValidity {
+			return uid, nil
+		}
+	}
+
+	if messageID == "" {
+		return 0, nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageID)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return 0, err
+	}
+
+	// If there are several copies, the one we just uploaded has the highest UID
+	var uid uint32
+	for _, u := range uids {
+		if u > uid {
+			uid = u
+		}
+	}
+	return uid, nil
+}
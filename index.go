@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/yzzyx/mr/config"
+	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
+)
+
+// indexAccounts implements "mr index", which adds new files in local maildir accounts to the
+// index, and removes files that are gone, without starting the UI
+func indexAccounts(db *notmuch.Database, cfg config.Config, maildirPath string, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: mr index")
+	}
+
+	var names []string
+	for name, account := range cfg.Mailboxes {
+		if account.Type == "maildir" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("no maildir accounts configured")
+	}
+	sort.Strings(names)
+
+	failed := false
+	for _, name := range names {
+		account := cfg.Mailboxes[name]
+		s, err := source.New(db, filepath.Join(maildirPath, name), &account)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+
+		err = source.Sync(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			failed = true
+		}
+		err = s.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if failed {
+		return errors.New("some folders could not be indexed")
+	}
+	return nil
+}
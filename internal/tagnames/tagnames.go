@@ -0,0 +1,6 @@
+// Package tagnames contains the names of notmuch tags with a special meaning,
+// shared by the mail sources and the user interface
+package tagnames
+
+// Partial is set on messages where only the headers have been downloaded
+const Partial = "partial"
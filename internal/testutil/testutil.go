@@ -0,0 +1,80 @@
+// Package testutil contains helpers shared by the tests of the mail sources
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/yzzyx/mr/notmuch"
+)
+
+// TempDir creates a temporary directory, and returns a function which removes it
+func TempDir(t *testing.T) (string, func()) {
+	path, err := ioutil.TempDir("", "mr-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { _ = os.RemoveAll(path) }
+}
+
+// Database is a notmuch database in a temporary directory
+type Database struct {
+	DB   *notmuch.Database
+	Path string
+}
+
+// NewDatabase creates a new notmuch database.
+// The test is skipped if notmuch isn't available.
+func NewDatabase(t *testing.T) *Database {
+	path, cleanup := TempDir(t)
+	db, st := notmuch.NewDatabase(path)
+	if st != notmuch.STATUS_SUCCESS {
+		cleanup()
+		t.Skip("cannot create notmuch database:", st)
+	}
+	return &Database{DB: db, Path: path}
+}
+
+// Close closes the database, and removes its directory
+func (td *Database) Close() {
+	td.DB.Close()
+	_ = os.RemoveAll(td.Path)
+}
+
+// Tags returns the tags of a message, or nil if the message isn't in the database
+func (td *Database) Tags(messageID string) map[string]bool {
+	td.DB.Lock()
+	defer td.DB.Unlock()
+
+	m, st := td.DB.FindMessage(messageID)
+	if m == nil || st != notmuch.STATUS_SUCCESS {
+		return nil
+	}
+	defer m.Destroy()
+
+	tags := make(map[string]bool)
+	it := m.GetTags()
+	for it.Valid() {
+		tags[it.Get()] = true
+		it.MoveToNext()
+	}
+	return tags
+}
+
+// SetTag adds or removes a tag of a message
+func (td *Database) SetTag(t *testing.T, messageID string, tag string, set bool) {
+	td.DB.Lock()
+	defer td.DB.Unlock()
+
+	m, st := td.DB.FindMessage(messageID)
+	if m == nil || st != notmuch.STATUS_SUCCESS {
+		t.Fatalf("message %s not found", messageID)
+	}
+	defer m.Destroy()
+	if set {
+		m.AddTag(tag)
+	} else {
+		m.RemoveTag(tag)
+	}
+}
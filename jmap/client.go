@@ -0,0 +1,204 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Capabilities used in requests
+const (
+	capabilityCore = "urn:ietf:params:jmap:core"
+	capabilityMail = "urn:ietf:params:jmap:mail"
+)
+
+// session is the JMAP session resource (RFC 8620, section 2)
+type session struct {
+	APIURL          string            `json:"apiUrl"`
+	DownloadURL     string            `json:"downloadUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+}
+
+// invocation is a method call or response, which is encoded as [name, arguments, call id]
+type invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (inv invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{inv.Name, inv.Args, inv.CallID})
+}
+
+func (inv *invocation) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid invocation %s", data)
+	}
+	err = json.Unmarshal(fields[0], &inv.Name)
+	if err != nil {
+		return err
+	}
+	inv.Args = fields[1]
+	return json.Unmarshal(fields[2], &inv.CallID)
+}
+
+type request struct {
+	Using       []string     `json:"using"`
+	MethodCalls []invocation `json:"methodCalls"`
+}
+
+type response struct {
+	MethodResponses []invocation `json:"methodResponses"`
+}
+
+// methodError is an error returned by the server for a single method call (RFC 8620, section 3.6.2)
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *methodError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("jmap error %s: %s", e.Type, e.Description)
+	}
+	return "jmap error " + e.Type
+}
+
+// client sends requests to a JMAP server
+type client struct {
+	http    *http.Client
+	account *Account
+
+	session   session
+	accountID string
+}
+
+// authorize adds the credentials of the account to a request
+func (c *client) authorize(req *http.Request) {
+	if c.account.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.account.Token)
+	} else {
+		req.SetBasicAuth(c.account.Username, c.account.Password)
+	}
+}
+
+// get sends a GET request, and returns the body of the response
+func (c *client) get(u string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// connect fetches the session resource, and finds the account used for mail
+func (c *client) connect() error {
+	body, err := c.get(c.account.SessionURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	err = json.NewDecoder(body).Decode(&c.session)
+	if err != nil {
+		return fmt.Errorf("invalid jmap session: %s", err)
+	}
+
+	c.accountID = c.session.PrimaryAccounts[capabilityMail]
+	if c.accountID == "" {
+		return fmt.Errorf("no mail account available at %s", c.account.SessionURL)
+	}
+	if c.session.APIURL == "" || c.session.DownloadURL == "" {
+		return fmt.Errorf("invalid jmap session: missing apiUrl or downloadUrl")
+	}
+	return nil
+}
+
+// call calls a single method, and decodes its response into result.
+// The account id is added to args.
+func (c *client) call(method string, args map[string]interface{}, result interface{}) error {
+	args["accountId"] = c.accountID
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	reqData, err := json.Marshal(request{
+		Using:       []string{capabilityCore, capabilityMail},
+		MethodCalls: []invocation{{Name: method, Args: data, CallID: "0"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.session.APIURL, bytes.NewReader(reqData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.authorize(req)
+
+	httpResp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return fmt.Errorf("%s: %s %s", method, httpResp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var resp response
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return fmt.Errorf("%s: invalid response: %s", method, err)
+	}
+	if len(resp.MethodResponses) != 1 {
+		return fmt.Errorf("%s: expected 1 response, got %d", method, len(resp.MethodResponses))
+	}
+
+	inv := resp.MethodResponses[0]
+	if inv.Name == "error" {
+		var merr methodError
+		err = json.Unmarshal(inv.Args, &merr)
+		if err != nil {
+			return err
+		}
+		return &merr
+	}
+	return json.Unmarshal(inv.Args, result)
+}
+
+// download returns the contents of a blob, such as the raw message of an email
+func (c *client) download(blobID string) (io.ReadCloser, error) {
+	u := c.session.DownloadURL
+	for name, value := range map[string]string{
+		"accountId": c.accountID,
+		"blobId":    blobID,
+		"type":      "message/rfc822",
+		"name":      "message.eml",
+	} {
+		u = strings.Replace(u, "{"+name+"}", url.PathEscape(value), -1)
+	}
+	return c.get(u)
+}
@@ -0,0 +1,780 @@
+// Package jmap synchronizes messages with JMAP servers (RFC 8620 and RFC 8621)
+package jmap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yzzyx/mr/config"
+	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
+)
+
+const (
+	// Maximum number of emails fetched by a single Email/get, Email/query or Email/set call
+	getBatchSize   = 100
+	queryBatchSize = 256
+	setBatchSize   = 100
+
+	// Maximum number of changes returned by a single Email/changes call
+	changesBatchSize = 256
+
+	// The synchronization state is saved after this many messages have been downloaded
+	checkpointInterval = 20
+)
+
+// Properties of emails that are synchronized
+var emailProperties = []string{"id", "blobId", "mailboxIds", "keywords"}
+
+// Account defines the available options for a JMAP account
+type Account struct {
+	// URL of the JMAP session resource, e.g. https://api.fastmail.com/jmap/session
+	SessionURL string `yaml:"session_url"`
+
+	// Credentials, either a username and password, or an API token
+	Username string
+	Password string
+	Token    string
+
+	// Timeout of requests in seconds
+	Timeout int
+
+	// Map from JMAP keywords to notmuch tags, overrides the default mapping
+	KeywordTags map[string]string `yaml:"keyword_tags"`
+	// Map from mailboxes to notmuch tags, overrides the default mapping
+	MailboxTags map[string]string `yaml:"mailbox_tags"`
+}
+
+// mailbox is a mailbox on the server
+type mailbox struct {
+	id   string
+	path string // Names of the mailbox and its parents, separated by "/"
+	role string
+}
+
+// email is an email on the server, as returned by Email/get
+type email struct {
+	ID         string          `json:"id"`
+	BlobID     string          `json:"blobId"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+}
+
+// syncPass keeps track of the changes on the server during a single synchronization pass
+type syncPass struct {
+	// State of the server that the changes lead up to
+	newState string
+
+	// Emails which have been created or updated, and emails which have been destroyed
+	emails    map[string]*email
+	destroyed []string
+
+	// Ids of the emails by the local folder of their home mailbox, sorted. Emails which
+	// aren't in any known mailbox are listed under an empty folder name.
+	folders map[string][]string
+
+	// Set if a folder has failed, in which case the changes are fetched again in the next pass
+	failed bool
+}
+
+// Handler synchronizes messages with a single JMAP account
+type Handler struct {
+	db          *notmuch.Database
+	maildirPath string
+	account     Account
+
+	state    state
+	lockFile *os.File
+
+	// Progress information is written to out
+	out io.Writer
+
+	// Connection used by the current synchronization pass, the mailboxes on the server by id, and
+	// the changes on the server
+	c         *client
+	mailboxes map[string]*mailbox
+	order     []string // Ids of the mailboxes, sorted by path
+	inbox     string   // Id of the inbox, if there is one
+	pass      *syncPass
+}
+
+func init() {
+	source.Register("jmap", newSource)
+}
+
+// newSource creates a handler from the configuration of an account
+func newSource(db *notmuch.Database, path string, account *config.Account) (source.MailSource, error) {
+	var a Account
+	err := account.Decode(&a)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, path, a)
+}
+
+// New creates a new Handler
+func New(db *notmuch.Database, maildirPath string, account Account) (*Handler, error) {
+	var err error
+	h := &Handler{
+		db:          db,
+		maildirPath: maildirPath,
+		account:     account,
+		out:         os.Stdout,
+	}
+
+	err = os.MkdirAll(maildirPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	h.lockFile, err = source.LockFile(filepath.Join(maildirPath, lockFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.loadState()
+	if err != nil {
+		source.UnlockFile(h.lockFile)
+		return nil, err
+	}
+	return h, nil
+}
+
+// SetOutput sets the destination of progress information (defaults to os.Stdout)
+func (h *Handler) SetOutput(w io.Writer) {
+	h.out = w
+}
+
+// Close saves the synchronization state
+func (h *Handler) Close() error {
+	defer source.UnlockFile(h.lockFile)
+	return h.saveState()
+}
+
+// Connect fetches the session and the mailboxes of the account, and the changes to emails
+// since the last synchronization pass
+func (h *Handler) Connect() error {
+	if h.account.SessionURL == "" {
+		return errors.New("jmap session url not configured")
+	}
+	if h.account.Token == "" && (h.account.Username == "" || h.account.Password == "") {
+		return errors.New("jmap credentials not configured")
+	}
+
+	timeout := source.DefaultTimeout
+	if h.account.Timeout > 0 {
+		timeout = time.Duration(h.account.Timeout) * time.Second
+	}
+	c := &client{http: &http.Client{Timeout: timeout}, account: &h.account}
+	err := c.connect()
+	if err != nil {
+		return err
+	}
+	h.c = c
+
+	err = h.loadMailboxes()
+	if err != nil {
+		return err
+	}
+
+	h.pass, err = h.fetchChanges()
+	if err != nil {
+		return err
+	}
+	h.pass.folders = h.groupByFolder(h.pass.emails)
+	return nil
+}
+
+// Disconnect ends the synchronization pass. If all changes on the server have been handled,
+// the next pass only asks for changes since this one.
+func (h *Handler) Disconnect() {
+	if h.pass != nil && !h.pass.failed {
+		complete := true
+		for folder, ids := range h.pass.folders {
+			for _, id := range ids {
+				if _, ok := h.state.Emails[id]; ok {
+					continue
+				}
+				if folder == "" {
+					fmt.Fprintf(h.out, " email %s is not in any known mailbox, skipping\n", id)
+					continue
+				}
+				complete = false
+			}
+		}
+		if complete {
+			h.state.EmailState = h.pass.newState
+		}
+	}
+
+	h.c = nil
+	h.pass = nil
+	h.checkpoint()
+}
+
+// loadMailboxes fetches the mailboxes of the account
+func (h *Handler) loadMailboxes() error {
+	var resp struct {
+		List []struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			ParentID string `json:"parentId"`
+			Role     string `json:"role"`
+		} `json:"list"`
+	}
+	err := h.c.call("Mailbox/get", map[string]interface{}{"ids": nil}, &resp)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]string)
+	parents := make(map[string]string)
+	for _, mb := range resp.List {
+		// Mailbox names may contain the separator used in paths
+		names[mb.ID] = strings.Replace(mb.Name, "/", "_", -1)
+		parents[mb.ID] = mb.ParentID
+	}
+
+	mailboxes := make(map[string]*mailbox)
+	for _, mb := range resp.List {
+		path := names[mb.ID]
+		valid := validMailboxName(path)
+		// Parents are limited to the number of mailboxes, in case the server returns a loop
+		parent := parents[mb.ID]
+		for i := 0; parent != "" && i < len(resp.List); i++ {
+			valid = valid && validMailboxName(names[parent])
+			path = names[parent] + "/" + path
+			parent = parents[parent]
+		}
+		if !valid {
+			fmt.Fprintf(h.out, "skipping mailbox %q, which can't be stored in the maildir\n", path)
+			continue
+		}
+		mailboxes[mb.ID] = &mailbox{id: mb.ID, path: path, role: strings.ToLower(mb.Role)}
+	}
+	h.setMailboxes(mailboxes)
+	return nil
+}
+
+// validMailboxName returns false for mailbox names which can't be used as folder names.
+// Such mailboxes, and their children, aren't synchronized.
+func validMailboxName(name string) bool {
+	return name != "" && name != "." && name != ".."
+}
+
+// folderPath returns the absolute path of the maildir of a folder. Folders are stored in
+// the same layout as IMAP folders, with each level of the mailbox hierarchy as a directory.
+func (h *Handler) folderPath(folder string) string {
+	return filepath.Join(h.maildirPath, source.LocalFolder(strings.Split(folder, "/"), source.LayoutNested))
+}
+
+// setMailboxes sets the mailboxes of the account, by id
+func (h *Handler) setMailboxes(mailboxes map[string]*mailbox) {
+	h.mailboxes = mailboxes
+	h.order = make([]string, 0, len(mailboxes))
+	for id := range mailboxes {
+		h.order = append(h.order, id)
+	}
+	sort.Slice(h.order, func(i, j int) bool { return mailboxes[h.order[i]].path < mailboxes[h.order[j]].path })
+	h.inbox = h.mailboxByRole("inbox")
+}
+
+// mailboxIDs returns the ids of all mailboxes, sorted by path
+func (h *Handler) mailboxIDs() []string {
+	return h.order
+}
+
+// mailboxByRole returns the id of the mailbox with a specific role, or an empty string if there is none
+func (h *Handler) mailboxByRole(role string) string {
+	for _, id := range h.order {
+		if h.mailboxes[id].role == role {
+			return id
+		}
+	}
+	return ""
+}
+
+// homeFolder returns the local folder where an email is stored: the inbox if the email is in it,
+// and otherwise the first of its mailboxes. An empty string is returned if it's not in any known mailbox.
+// When the home mailbox of an email changes on the server, the file is moved to the new folder.
+func (h *Handler) homeFolder(e *email) string {
+	if h.inbox != "" && e.MailboxIDs[h.inbox] {
+		return h.mailboxes[h.inbox].path
+	}
+	for _, id := range h.order {
+		if e.MailboxIDs[id] {
+			return h.mailboxes[id].path
+		}
+	}
+	return ""
+}
+
+// groupByFolder returns the ids of emails by the folder of their home mailbox, sorted
+func (h *Handler) groupByFolder(emails map[string]*email) map[string][]string {
+	folders := make(map[string][]string)
+	for id, e := range emails {
+		folder := h.homeFolder(e)
+		folders[folder] = append(folders[folder], id)
+	}
+	for _, ids := range folders {
+		sort.Strings(ids)
+	}
+	return folders
+}
+
+// ListFolders returns the paths of all mailboxes. Each email is stored in the folder of one of its mailboxes.
+func (h *Handler) ListFolders() ([]string, error) {
+	var folders []string
+	for _, id := range h.mailboxIDs() {
+		folders = append(folders, h.mailboxes[id].path)
+	}
+	return folders, nil
+}
+
+// fetchChanges returns the emails which have changed since the last synchronization pass.
+// All emails are returned if this is the first pass, or if the server can't calculate the changes.
+func (h *Handler) fetchChanges() (*syncPass, error) {
+	if h.state.EmailState != "" {
+		pass, err := h.emailChanges(h.state.EmailState)
+		if err == nil {
+			return pass, nil
+		}
+		if merr, ok := err.(*methodError); !ok || merr.Type != "cannotCalculateChanges" {
+			return nil, err
+		}
+		fmt.Fprintln(h.out, "cannot get changes since the last synchronization, checking all emails")
+	}
+	return h.allEmails()
+}
+
+// emailChanges returns the emails which have changed since a specific state
+func (h *Handler) emailChanges(since string) (*syncPass, error) {
+	pass := &syncPass{emails: make(map[string]*email)}
+	var ids []string
+	for {
+		var resp struct {
+			NewState       string   `json:"newState"`
+			HasMoreChanges bool     `json:"hasMoreChanges"`
+			Created        []string `json:"created"`
+			Updated        []string `json:"updated"`
+			Destroyed      []string `json:"destroyed"`
+		}
+		err := h.c.call("Email/changes", map[string]interface{}{
+			"sinceState": since,
+			"maxChanges": changesBatchSize,
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, resp.Created...)
+		ids = append(ids, resp.Updated...)
+		pass.destroyed = append(pass.destroyed, resp.Destroyed...)
+		since = resp.NewState
+		if !resp.HasMoreChanges {
+			break
+		}
+	}
+	pass.newState = since
+
+	err := h.getEmails(pass, ids)
+	if err != nil {
+		return nil, err
+	}
+	return pass, nil
+}
+
+// allEmails returns all emails on the server. Emails we've seen before which are no longer
+// on the server are returned as destroyed.
+func (h *Handler) allEmails() (*syncPass, error) {
+	// The state is fetched first, so that changes made while listing the emails are seen in the next pass
+	var getResp struct {
+		State string `json:"state"`
+	}
+	err := h.c.call("Email/get", map[string]interface{}{"ids": []string{}}, &getResp)
+	if err != nil {
+		return nil, err
+	}
+	pass := &syncPass{newState: getResp.State, emails: make(map[string]*email)}
+
+	var ids []string
+	for {
+		var resp struct {
+			IDs []string `json:"ids"`
+		}
+		err = h.c.call("Email/query", map[string]interface{}{
+			"position": len(ids),
+			"limit":    queryBatchSize,
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.IDs) == 0 {
+			break
+		}
+		ids = append(ids, resp.IDs...)
+	}
+
+	onServer := source.StringSet(ids)
+	for id := range h.state.Emails {
+		if !onServer[id] {
+			pass.destroyed = append(pass.destroyed, id)
+		}
+	}
+
+	err = h.getEmails(pass, ids)
+	if err != nil {
+		return nil, err
+	}
+	return pass, nil
+}
+
+// getEmails fetches the properties of emails, and adds them to the pass.
+// Emails which have been destroyed in the meantime are skipped.
+func (h *Handler) getEmails(pass *syncPass, ids []string) error {
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > getBatchSize {
+			batch = batch[:getBatchSize]
+		}
+		ids = ids[len(batch):]
+
+		var resp struct {
+			List []*email `json:"list"`
+		}
+		err := h.c.call("Email/get", map[string]interface{}{
+			"ids":        batch,
+			"properties": emailProperties,
+		}, &resp)
+		if err != nil {
+			return err
+		}
+		for _, e := range resp.List {
+			pass.emails[e.ID] = e
+		}
+	}
+	return nil
+}
+
+// remoteState returns the state of an email on the server
+func remoteState(e *email) *emailState {
+	keywords := make(map[string]bool)
+	for keyword, set := range e.Keywords {
+		// Keywords are case-insensitive
+		keywords[strings.ToLower(keyword)] = set
+	}
+	return &emailState{
+		Keywords:  setList(keywords),
+		Mailboxes: setList(e.MailboxIDs),
+	}
+}
+
+// FetchNew downloads new emails stored in a folder, moves emails whose home mailbox has changed
+// to it, and removes emails which have been destroyed on the server
+func (h *Handler) FetchNew(folder string) error {
+	err := h.fetchNew(folder)
+	if err != nil {
+		h.pass.failed = true
+	}
+	h.checkpoint()
+	return err
+}
+
+func (h *Handler) fetchNew(folder string) error {
+	stored := 0
+	for _, id := range h.pass.folders[folder] {
+		if state, ok := h.state.Emails[id]; ok {
+			if state.Folder != folder {
+				err := h.moveEmail(state, folder)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		state, err := h.storeEmail(folder, h.pass.emails[id])
+		if err != nil {
+			return err
+		}
+		h.state.Emails[id] = state
+
+		stored++
+		if stored%checkpointInterval == 0 {
+			h.checkpoint()
+		}
+	}
+
+	for _, id := range h.pass.destroyed {
+		state, ok := h.state.Emails[id]
+		if !ok || state.Folder != folder {
+			continue
+		}
+		err := h.removeEmail(state)
+		if err != nil {
+			return err
+		}
+		delete(h.state.Emails, id)
+	}
+	return nil
+}
+
+// storeEmail downloads an email, stores it in the maildir of a folder, and adds it to the index
+// with the tags matching its keywords and mailboxes
+func (h *Handler) storeEmail(folder string, e *email) (*emailState, error) {
+	body, err := h.c.download(e.BlobID)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	remote := remoteState(e)
+	newPath, err := source.StoreMaildirMessage(h.folderPath(folder), body, "", source.MaildirInfo(remote.Keywords, maildirKeywords))
+	if err != nil {
+		return nil, err
+	}
+
+	// Add file to index
+	h.db.Lock()
+	defer h.db.Unlock()
+	m, st := h.db.AddMessage(newPath)
+	if m == nil {
+		return nil, errors.New(st.String())
+	}
+	defer m.Destroy()
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return nil, errors.New(st.String())
+	}
+
+	// The tags are set from the server, as in the first synchronization of an existing message
+	state := &emailState{MessageID: m.GetMessageId(), Folder: folder}
+	merged, _, changes := h.merge(remote, state, nil)
+	m.Freeze()
+	for _, tag := range changes.add {
+		m.AddTag(tag)
+	}
+	for _, tag := range changes.remove {
+		m.RemoveTag(tag)
+	}
+	m.Thaw()
+	fmt.Fprintf(h.out, " tagging %s: %s\n", filepath.Base(newPath), changes)
+	return merged, nil
+}
+
+// maildirKeywords maps JMAP keywords to maildir info flags
+var maildirKeywords = map[string]byte{
+	"$draft":    'D',
+	"$flagged":  'F',
+	"$answered": 'R',
+	"$seen":     'S',
+}
+
+// emailFile returns the path of the local file of an email, or an empty string if it has none.
+// Other copies of the message, outside the folder of the email, are ignored.
+// The database must be locked by the caller.
+func (h *Handler) emailFile(state *emailState) string {
+	m, st := h.db.FindMessage(state.MessageID)
+	if m == nil || st != notmuch.STATUS_SUCCESS {
+		return ""
+	}
+	defer m.Destroy()
+
+	folderPath := h.folderPath(state.Folder)
+	filenames := m.GetFileNames()
+	defer filenames.Destroy()
+	for filenames.Valid() {
+		path := filenames.Get()
+		if filepath.Dir(filepath.Dir(path)) == folderPath {
+			return path
+		}
+		filenames.MoveToNext()
+	}
+	return ""
+}
+
+// removeEmail removes the local file of an email which has been destroyed on the server
+func (h *Handler) removeEmail(state *emailState) error {
+	h.db.Lock()
+	defer h.db.Unlock()
+
+	path := h.emailFile(state)
+	if path == "" {
+		return nil
+	}
+
+	fmt.Fprintf(h.out, " removing %s from %s\n", filepath.Base(path), state.Folder)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	st := h.db.RemoveMessage(path)
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return errors.New(st.String())
+	}
+	return nil
+}
+
+// moveEmail moves the local file of an email to the folder of its new home mailbox.
+// The new path is added to the index before the old one is removed, so that the
+// message stays in the index if something fails.
+func (h *Handler) moveEmail(state *emailState, folder string) error {
+	h.db.Lock()
+	defer h.db.Unlock()
+
+	path := h.emailFile(state)
+	if path == "" {
+		state.Folder = folder
+		return nil
+	}
+
+	folderPath := h.folderPath(folder)
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(folderPath, dir), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(h.out, " moving %s from %s to %s\n", filepath.Base(path), state.Folder, folder)
+	newPath := filepath.Join(folderPath, "cur", filepath.Base(path))
+	err := os.Rename(path, newPath)
+	if err != nil {
+		return err
+	}
+
+	m, st := h.db.AddMessage(newPath)
+	if m != nil {
+		m.Destroy()
+	}
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		// Put the file back where the index expects it
+		_ = os.Rename(newPath, path)
+		return errors.New(st.String())
+	}
+
+	st = h.db.RemoveMessage(path)
+	if st != notmuch.STATUS_SUCCESS && st != notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		return errors.New(st.String())
+	}
+	state.Folder = folder
+	return nil
+}
+
+// PushChanges synchronizes keywords and mailboxes with the tags of the messages stored in a folder.
+// Changes on either side are merged, and changes on both sides are resolved in favour of the server.
+func (h *Handler) PushChanges(folder string) error {
+	err := h.pushChanges(folder)
+	if err != nil {
+		h.pass.failed = true
+	}
+	h.checkpoint()
+	return err
+}
+
+func (h *Handler) pushChanges(folder string) error {
+	ids := make([]string, 0, len(h.state.Emails))
+	for id, state := range h.state.Emails {
+		if state.Folder == folder {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	updates := make(map[string]interface{})
+	newStates := make(map[string]*emailState)
+
+	h.db.Lock()
+	for _, id := range ids {
+		last := h.state.Emails[id]
+		remote := last
+		if e, ok := h.pass.emails[id]; ok {
+			remote = remoteState(e)
+		}
+
+		tags, ok := source.LocalTags(h.db, last.MessageID)
+		if !ok {
+			continue
+		}
+
+		merged, patch, changes := h.merge(remote, last, tags)
+		if len(changes.add) > 0 || len(changes.remove) > 0 {
+			m, _ := h.db.FindMessage(last.MessageID)
+			if m != nil {
+				m.Freeze()
+				for _, tag := range changes.add {
+					m.AddTag(tag)
+				}
+				for _, tag := range changes.remove {
+					m.RemoveTag(tag)
+				}
+				m.Thaw()
+				m.TagsToMaildirFlags()
+				m.Destroy()
+			}
+			fmt.Fprintf(h.out, " updating tags for %s: %s\n", last.MessageID, changes)
+		}
+
+		if patch != nil {
+			updates[id] = patch
+			newStates[id] = merged
+		} else {
+			h.state.Emails[id] = merged
+		}
+	}
+	h.db.Unlock()
+
+	return h.updateEmails(updates, newStates)
+}
+
+// updateEmails sends patches to the server. The state of an email is only updated once
+// the server has accepted its patch, so that local changes aren't lost.
+func (h *Handler) updateEmails(updates map[string]interface{}, newStates map[string]*emailState) error {
+	ids := make([]string, 0, len(updates))
+	for id := range updates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var failures []string
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > setBatchSize {
+			batch = batch[:setBatchSize]
+		}
+		ids = ids[len(batch):]
+
+		update := make(map[string]interface{}, len(batch))
+		for _, id := range batch {
+			update[id] = updates[id]
+		}
+
+		var resp struct {
+			Updated    map[string]interface{} `json:"updated"`
+			NotUpdated map[string]methodError `json:"notUpdated"`
+		}
+		err := h.c.call("Email/set", map[string]interface{}{"update": update}, &resp)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range batch {
+			if _, ok := resp.Updated[id]; ok {
+				h.state.Emails[id] = newStates[id]
+			} else if merr, ok := resp.NotUpdated[id]; ok {
+				failures = append(failures, fmt.Sprintf("%s: %s", id, &merr))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("could not update %d email(s): %s", len(failures), strings.Join(failures, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package jmap
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/yzzyx/mr/internal/testutil"
+	"github.com/yzzyx/mr/source"
+)
+
+func TestConnect(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.addEmail("1@example.org", []string{"mb-inbox"})
+	ts.addEmail("2@example.org", []string{"mb-lists"}, "$seen")
+
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+
+	account := ts.account()
+	account.Token = "wrong"
+	h := newTestHandler(t, nil, path, account)
+	err := h.Connect()
+	if err == nil {
+		t.Error("expected wrong token to fail")
+	}
+	_ = h.Close()
+
+	h = newTestHandler(t, nil, path, ts.account())
+	defer h.Close()
+	err = h.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folders, err := h.ListFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Archive", "Inbox", "Inbox/Lists"}
+	if !reflect.DeepEqual(folders, expected) {
+		t.Errorf("expected folders %v, got %v", expected, folders)
+	}
+
+	if len(h.pass.emails) != 2 || h.pass.newState != "2" {
+		t.Errorf("expected 2 emails in state 2, got %d emails in state %s", len(h.pass.emails), h.pass.newState)
+	}
+	e := h.pass.emails["email2"]
+	if e == nil || !e.Keywords["$seen"] || h.homeFolder(e) != "Inbox/Lists" {
+		t.Errorf("unexpected email %+v", e)
+	}
+}
+
+func TestMailboxNames(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.mailboxes = append(ts.mailboxes,
+		map[string]interface{}{"id": "mb-parent", "name": "..", "role": nil, "parentId": nil},
+		map[string]interface{}{"id": "mb-child", "name": "Child", "role": nil, "parentId": "mb-parent"},
+		map[string]interface{}{"id": "mb-dot", "name": ".", "role": nil, "parentId": "mb-inbox"},
+		map[string]interface{}{"id": "mb-empty", "name": "", "role": nil, "parentId": nil},
+		map[string]interface{}{"id": "mb-slash", "name": "a/b", "role": nil, "parentId": nil},
+	)
+
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+	h := newTestHandler(t, nil, path, ts.account())
+	defer h.Close()
+	err := h.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mailboxes named "", "." or "..", and their children, are skipped
+	folders, err := h.ListFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Archive", "Inbox", "Inbox/Lists", "a_b"}
+	if !reflect.DeepEqual(folders, expected) {
+		t.Errorf("expected folders %v, got %v", expected, folders)
+	}
+
+	// Folders are always stored below the maildir of the account
+	for folder, expected := range map[string]string{
+		"Inbox/Lists": filepath.Join(h.maildirPath, "Inbox", "Lists"),
+		"a_b":         filepath.Join(h.maildirPath, "a_b"),
+		"..":          filepath.Join(h.maildirPath, "___"),
+		"Inbox/.":     filepath.Join(h.maildirPath, "Inbox", "__"),
+		"":            filepath.Join(h.maildirPath, "_"),
+	} {
+		if folderPath := h.folderPath(folder); folderPath != expected {
+			t.Errorf("expected path %s for %q, got %s", expected, folder, folderPath)
+		}
+	}
+}
+
+func TestEmailChanges(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	first := ts.addEmail("1@example.org", []string{"mb-inbox"})
+	second := ts.addEmail("2@example.org", []string{"mb-inbox"})
+
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+	h := newTestHandler(t, nil, path, ts.account())
+	defer h.Close()
+
+	// Pretend that both emails have been downloaded
+	h.state.EmailState = "2"
+	for _, id := range []string{first, second} {
+		h.state.Emails[id] = &emailState{Folder: "Inbox", Keywords: []string{}, Mailboxes: []string{"mb-inbox"}}
+	}
+
+	third := ts.addEmail("3@example.org", []string{"mb-archive"})
+	ts.setKeyword(first, "$flagged", true)
+	ts.destroyEmail(second)
+
+	err := h.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for id := range h.pass.emails {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{first, third}) {
+		t.Errorf("expected changed emails %v, got %v", []string{first, third}, ids)
+	}
+	if !reflect.DeepEqual(h.pass.destroyed, []string{second}) {
+		t.Errorf("expected destroyed emails %v, got %v", []string{second}, h.pass.destroyed)
+	}
+
+	// If the server can't calculate the changes, all emails are checked
+	ts.oldestState = 10
+	err = h.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.pass.emails) != 2 || !reflect.DeepEqual(h.pass.destroyed, []string{second}) {
+		t.Errorf("expected all emails after failing to get changes, got %d emails and %v destroyed",
+			len(h.pass.emails), h.pass.destroyed)
+	}
+}
+
+func TestGroupByFolder(t *testing.T) {
+	h := &Handler{}
+	h.setMailboxes(map[string]*mailbox{
+		"mb-inbox": {id: "mb-inbox", path: "Inbox", role: "inbox"},
+		"mb-lists": {id: "mb-lists", path: "Inbox/Lists"},
+		"mb-work":  {id: "mb-work", path: "Work"},
+	})
+
+	emails := map[string]*email{
+		"e1": {ID: "e1", MailboxIDs: map[string]bool{"mb-work": true, "mb-inbox": true}},
+		"e2": {ID: "e2", MailboxIDs: map[string]bool{"mb-work": true, "mb-lists": true}},
+		"e3": {ID: "e3", MailboxIDs: map[string]bool{"mb-work": true}},
+		"e4": {ID: "e4", MailboxIDs: map[string]bool{"mb-unknown": true}},
+	}
+	expected := map[string][]string{
+		"Inbox":       {"e1"},
+		"Inbox/Lists": {"e2"},
+		"Work":        {"e3"},
+		"":            {"e4"},
+	}
+	if folders := h.groupByFolder(emails); !reflect.DeepEqual(folders, expected) {
+		t.Errorf("expected folders %v, got %v", expected, folders)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	h := &Handler{}
+	h.setMailboxes(map[string]*mailbox{
+		"mb-inbox":   {id: "mb-inbox", path: "Inbox", role: "inbox"},
+		"mb-archive": {id: "mb-archive", path: "Archive", role: "archive"},
+		"mb-lists":   {id: "mb-lists", path: "Lists"},
+	})
+
+	tests := []struct {
+		name      string
+		remote    emailState
+		last      emailState
+		tags      []string
+		mailboxes []string
+		keywords  []string
+		patch     map[string]interface{}
+		changes   string
+	}{
+		{
+			name:      "unchanged",
+			remote:    emailState{Keywords: []string{"$seen"}, Mailboxes: []string{"mb-inbox"}},
+			last:      emailState{Keywords: []string{"$seen"}, Mailboxes: []string{"mb-inbox"}},
+			tags:      []string{"inbox"},
+			keywords:  []string{"$seen"},
+			mailboxes: []string{"mb-inbox"},
+			changes:   "",
+		},
+		{
+			name:      "read locally",
+			remote:    emailState{Keywords: []string{}, Mailboxes: []string{"mb-inbox"}},
+			last:      emailState{Keywords: []string{}, Mailboxes: []string{"mb-inbox"}},
+			tags:      []string{"inbox"},
+			keywords:  []string{"$seen"},
+			mailboxes: []string{"mb-inbox"},
+			patch:     map[string]interface{}{"keywords/$seen": true},
+			changes:   "",
+		},
+		{
+			name:      "flagged on server",
+			remote:    emailState{Keywords: []string{"$flagged", "$seen"}, Mailboxes: []string{"mb-inbox"}},
+			last:      emailState{Keywords: []string{"$seen"}, Mailboxes: []string{"mb-inbox"}},
+			tags:      []string{"inbox"},
+			keywords:  []string{"$flagged", "$seen"},
+			mailboxes: []string{"mb-inbox"},
+			changes:   "+flagged",
+		},
+		{
+			name:      "tagged locally",
+			remote:    emailState{Keywords: []string{"$seen"}, Mailboxes: []string{"mb-inbox"}},
+			last:      emailState{Keywords: []string{"$seen"}, Mailboxes: []string{"mb-inbox"}},
+			tags:      []string{"inbox", "lists"},
+			keywords:  []string{"$seen"},
+			mailboxes: []string{"mb-inbox", "mb-lists"},
+			patch:     map[string]interface{}{"mailboxIds/mb-lists": true},
+			changes:   "",
+		},
+		{
+			name:      "archived locally",
+			remote:    emailState{Keywords: []string{"$seen"}, Mailboxes: []string{"mb-inbox"}},
+			last:      emailState{Keywords: []string{"$seen"}, Mailboxes: []string{"mb-inbox"}},
+			tags:      []string{},
+			keywords:  []string{"$seen"},
+			mailboxes: []string{"mb-archive"},
+			patch:     map[string]interface{}{"mailboxIds/mb-inbox": nil, "mailboxIds/mb-archive": true},
+			changes:   "",
+		},
+		{
+			name:      "never synchronized",
+			remote:    emailState{Keywords: []string{}, Mailboxes: []string{"mb-lists"}},
+			last:      emailState{},
+			tags:      []string{"inbox", "flagged"},
+			keywords:  []string{},
+			mailboxes: []string{"mb-lists"},
+			changes:   "+unread,+lists,-flagged,-inbox",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, patch, changes := h.merge(&test.remote, &test.last, source.StringSet(test.tags))
+			if !reflect.DeepEqual(merged.Keywords, test.keywords) {
+				t.Errorf("expected keywords %v, got %v", test.keywords, merged.Keywords)
+			}
+			if !reflect.DeepEqual(merged.Mailboxes, test.mailboxes) {
+				t.Errorf("expected mailboxes %v, got %v", test.mailboxes, merged.Mailboxes)
+			}
+			if !reflect.DeepEqual(patch, test.patch) {
+				t.Errorf("expected patch %v, got %v", test.patch, patch)
+			}
+			if changes.String() != test.changes {
+				t.Errorf("expected tag changes %q, got %q", test.changes, changes.String())
+			}
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	td := testutil.NewDatabase(t)
+	defer td.Close()
+
+	first := ts.addEmail("1@example.org", []string{"mb-inbox"})
+	second := ts.addEmail("2@example.org", []string{"mb-lists"}, "$seen")
+
+	h := newTestHandler(t, td.DB, td.Path, ts.account())
+	defer h.Close()
+	err := source.Sync(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := td.Tags("1@example.org")
+	if !tags["inbox"] || !tags["unread"] {
+		t.Errorf("expected first message to be tagged inbox and unread, got %v", tags)
+	}
+	tags = td.Tags("2@example.org")
+	if !tags["inbox/lists"] || tags["unread"] || tags["inbox"] {
+		t.Errorf("expected second message to be tagged inbox/lists, got %v", tags)
+	}
+
+	// Changes are synchronized in both directions
+	td.SetTag(t, "1@example.org", "unread", false)
+	ts.setKeyword(second, "$flagged", true)
+	err = source.Sync(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keywords, _ := ts.email(first)
+	if !reflect.DeepEqual(keywords, []string{"$seen"}) {
+		t.Errorf("expected first email to be seen, got keywords %v", keywords)
+	}
+	if tags := td.Tags("2@example.org"); !tags["flagged"] {
+		t.Errorf("expected second message to be flagged, got %v", tags)
+	}
+
+	// Emails are moved when their home mailbox changes
+	ts.moveEmail(second, []string{"mb-archive"})
+	err = source.Sync(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder := h.state.Emails[second].Folder; folder != "Archive" {
+		t.Errorf("expected second email in Archive, got %s", folder)
+	}
+	files, err := filepath.Glob(filepath.Join(h.maildirPath, "Archive", "cur", "*"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("expected one file in Archive, got %v (%v)", files, err)
+	}
+	files, err = filepath.Glob(filepath.Join(h.maildirPath, "Inbox", "Lists", "cur", "*"))
+	if err != nil || len(files) != 0 {
+		t.Errorf("expected no files left in Inbox/Lists, got %v (%v)", files, err)
+	}
+	if tags := td.Tags("2@example.org"); tags == nil || tags["inbox/lists"] {
+		t.Errorf("expected moved message to be indexed without the inbox/lists tag, got %v", tags)
+	}
+
+	// Destroyed emails are removed
+	ts.destroyEmail(first)
+	err = source.Sync(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := td.Tags("1@example.org"); tags != nil {
+		t.Errorf("expected first message to be removed, got tags %v", tags)
+	}
+	if _, ok := h.state.Emails[first]; ok {
+		t.Error("expected first email to be removed from the state")
+	}
+}
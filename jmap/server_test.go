@@ -0,0 +1,349 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
+)
+
+const (
+	testAccountID = "account1"
+	testToken     = "secret-token"
+)
+
+// testEmail is an email stored by testServer
+type testEmail struct {
+	mailboxIDs map[string]bool
+	keywords   map[string]bool
+	body       string
+
+	created int // State in which the email was created
+	changed int // State in which the email was last changed
+}
+
+// testServer is a JMAP server, which implements the parts of RFC 8620 and RFC 8621 used by the handler.
+// Every change to an email increases the state of the server by one.
+type testServer struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	mailboxes []map[string]interface{}
+	emails    map[string]*testEmail
+	destroyed map[string]int // State in which an email was destroyed, by id
+	state     int
+	nextID    int
+
+	// Email/changes fails with cannotCalculateChanges for states before this one
+	oldestState int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ts := &testServer{
+		mailboxes: []map[string]interface{}{
+			{"id": "mb-inbox", "name": "Inbox", "role": "inbox", "parentId": nil},
+			{"id": "mb-archive", "name": "Archive", "role": "archive", "parentId": nil},
+			{"id": "mb-lists", "name": "Lists", "role": nil, "parentId": "mb-inbox"},
+		},
+		emails:    make(map[string]*testEmail),
+		destroyed: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", ts.handleSession)
+	mux.HandleFunc("/api", ts.handleAPI)
+	mux.HandleFunc("/download/", ts.handleDownload)
+	ts.server = httptest.NewServer(mux)
+	return ts
+}
+
+func (ts *testServer) Close() {
+	ts.server.Close()
+}
+
+// account returns a configuration which connects to the server
+func (ts *testServer) account() Account {
+	return Account{
+		SessionURL: ts.server.URL + "/session",
+		Token:      testToken,
+	}
+}
+
+// addEmail adds an email to the server, and returns its id
+func (ts *testServer) addEmail(messageID string, mailboxIDs []string, keywords ...string) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.nextID++
+	ts.state++
+	id := fmt.Sprintf("email%d", ts.nextID)
+	ts.emails[id] = &testEmail{
+		mailboxIDs: source.StringSet(mailboxIDs),
+		keywords:   source.StringSet(keywords),
+		body: "From: sender@example.org\r\n" +
+			"Subject: Message " + messageID + "\r\n" +
+			"Message-ID: <" + messageID + ">\r\n" +
+			"\r\n" +
+			"Hello\r\n",
+		created: ts.state,
+		changed: ts.state,
+	}
+	return id
+}
+
+// setKeyword sets or unsets a keyword of an email
+func (ts *testServer) setKeyword(id string, keyword string, set bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.state++
+	e := ts.emails[id]
+	if set {
+		e.keywords[keyword] = true
+	} else {
+		delete(e.keywords, keyword)
+	}
+	e.changed = ts.state
+}
+
+// moveEmail replaces the mailboxes of an email
+func (ts *testServer) moveEmail(id string, mailboxIDs []string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.state++
+	e := ts.emails[id]
+	e.mailboxIDs = source.StringSet(mailboxIDs)
+	e.changed = ts.state
+}
+
+// destroyEmail removes an email from the server
+func (ts *testServer) destroyEmail(id string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.state++
+	delete(ts.emails, id)
+	ts.destroyed[id] = ts.state
+}
+
+// email returns the keywords and mailboxes of an email
+func (ts *testServer) email(id string) (keywords []string, mailboxIDs []string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	e := ts.emails[id]
+	return setList(e.keywords), setList(e.mailboxIDs)
+}
+
+func (ts *testServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (ts *testServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	if !ts.authorized(w, r) {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"apiUrl":          ts.server.URL + "/api",
+		"downloadUrl":     ts.server.URL + "/download/{accountId}/{blobId}/{name}?accept={type}",
+		"primaryAccounts": map[string]string{capabilityMail: testAccountID},
+	})
+}
+
+func (ts *testServer) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if !ts.authorized(w, r) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/download/"), "/")
+	if len(parts) != 3 || parts[0] != testAccountID {
+		http.NotFound(w, r)
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	e, ok := ts.emails[strings.TrimPrefix(parts[1], "blob-")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", r.URL.Query().Get("accept"))
+	_, _ = w.Write([]byte(e.body))
+}
+
+func (ts *testServer) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if !ts.authorized(w, r) {
+		return
+	}
+
+	var req request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var resp response
+	for _, call := range req.MethodCalls {
+		var args map[string]interface{}
+		err = json.Unmarshal(call.Args, &args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		name := call.Name
+		var result interface{}
+		if args["accountId"] != testAccountID {
+			name, result = "error", &methodError{Type: "accountNotFound"}
+		} else {
+			switch call.Name {
+			case "Mailbox/get":
+				result = map[string]interface{}{"list": ts.mailboxes}
+			case "Email/get":
+				result = ts.emailGet(args)
+			case "Email/query":
+				result = ts.emailQuery(args)
+			case "Email/changes":
+				result, err = ts.emailChanges(args)
+			case "Email/set":
+				result = ts.emailSet(args)
+			default:
+				err = &methodError{Type: "unknownMethod"}
+			}
+		}
+		if err != nil {
+			name, result = "error", err
+		}
+
+		data, _ := json.Marshal(result)
+		resp.MethodResponses = append(resp.MethodResponses, invocation{Name: name, Args: data, CallID: call.CallID})
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// sortedIDs returns the ids of all emails on the server
+func (ts *testServer) sortedIDs() []string {
+	ids := make([]string, 0, len(ts.emails))
+	for id := range ts.emails {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (ts *testServer) emailGet(args map[string]interface{}) interface{} {
+	list := []map[string]interface{}{}
+	notFound := []string{}
+	ids, _ := args["ids"].([]interface{})
+	for _, id := range ids {
+		e, ok := ts.emails[id.(string)]
+		if !ok {
+			notFound = append(notFound, id.(string))
+			continue
+		}
+		list = append(list, map[string]interface{}{
+			"id":         id,
+			"blobId":     "blob-" + id.(string),
+			"mailboxIds": e.mailboxIDs,
+			"keywords":   e.keywords,
+		})
+	}
+	return map[string]interface{}{"state": strconv.Itoa(ts.state), "list": list, "notFound": notFound}
+}
+
+func (ts *testServer) emailQuery(args map[string]interface{}) interface{} {
+	ids := ts.sortedIDs()
+	position := int(args["position"].(float64))
+	limit := int(args["limit"].(float64))
+	if position > len(ids) {
+		position = len(ids)
+	}
+	ids = ids[position:]
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return map[string]interface{}{"ids": ids}
+}
+
+func (ts *testServer) emailChanges(args map[string]interface{}) (interface{}, error) {
+	since, err := strconv.Atoi(args["sinceState"].(string))
+	if err != nil || since < ts.oldestState {
+		return nil, &methodError{Type: "cannotCalculateChanges"}
+	}
+
+	created, updated, destroyed := []string{}, []string{}, []string{}
+	for _, id := range ts.sortedIDs() {
+		e := ts.emails[id]
+		if e.created > since {
+			created = append(created, id)
+		} else if e.changed > since {
+			updated = append(updated, id)
+		}
+	}
+	for id, state := range ts.destroyed {
+		if state > since {
+			destroyed = append(destroyed, id)
+		}
+	}
+	return map[string]interface{}{
+		"oldState":       args["sinceState"],
+		"newState":       strconv.Itoa(ts.state),
+		"hasMoreChanges": false,
+		"created":        created,
+		"updated":        updated,
+		"destroyed":      destroyed,
+	}, nil
+}
+
+func (ts *testServer) emailSet(args map[string]interface{}) interface{} {
+	updated := map[string]interface{}{}
+	notUpdated := map[string]interface{}{}
+	update, _ := args["update"].(map[string]interface{})
+	for id, p := range update {
+		e, ok := ts.emails[id]
+		if !ok {
+			notUpdated[id] = &methodError{Type: "notFound"}
+			continue
+		}
+
+		ts.state++
+		for path, value := range p.(map[string]interface{}) {
+			parts := strings.SplitN(path, "/", 2)
+			set := map[string]map[string]bool{"keywords": e.keywords, "mailboxIds": e.mailboxIDs}[parts[0]]
+			if value == true {
+				set[parts[1]] = true
+			} else {
+				delete(set, parts[1])
+			}
+		}
+		e.changed = ts.state
+		updated[id] = nil
+	}
+	return map[string]interface{}{"newState": strconv.Itoa(ts.state), "updated": updated, "notUpdated": notUpdated}
+}
+
+// newTestHandler creates a handler storing messages in a subdirectory of 'path'.
+// db may be nil for tests which don't download messages.
+func newTestHandler(t *testing.T, db *notmuch.Database, path string, account Account) *Handler {
+	h, err := New(db, filepath.Join(path, "test"), account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetOutput(ioutil.Discard)
+	return h
+}
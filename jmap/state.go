@@ -0,0 +1,65 @@
+package jmap
+
+import (
+	"path/filepath"
+
+	"github.com/yzzyx/mr/source"
+)
+
+// Version of the format of the state file
+const stateVersion = 1
+
+// Files in the maildir of a handler
+const (
+	stateFilename = ".jmap-state"
+	lockFilename  = ".jmap-state.lock"
+)
+
+type state struct {
+	// Version of the state format, see stateVersion
+	Version int
+
+	// State string of the emails on the server, used to ask for changes since the last pass
+	EmailState string
+
+	// Emails which have been downloaded, by JMAP id
+	Emails map[string]*emailState
+}
+
+// emailState describes an email on the server, as it looked when it was last synchronized
+type emailState struct {
+	MessageID string
+	Folder    string   // Local folder where the message is stored
+	Keywords  []string // Synchronized keywords set on the email
+	Mailboxes []string // Ids of the mailboxes containing the email
+}
+
+// loadState reads the synchronization state of the handler
+func (h *Handler) loadState() error {
+	h.state.Version = stateVersion
+	h.state.Emails = make(map[string]*emailState)
+
+	path := filepath.Join(h.maildirPath, stateFilename)
+	_, err := source.LoadState(path, &h.state)
+	if err != nil {
+		return err
+	}
+	err = source.CheckStateVersion(path, h.state.Version, stateVersion)
+	if err != nil {
+		return err
+	}
+	if h.state.Emails == nil {
+		h.state.Emails = make(map[string]*emailState)
+	}
+	return nil
+}
+
+// saveState writes the synchronization state of the handler
+func (h *Handler) saveState() error {
+	return source.SaveState(filepath.Join(h.maildirPath, stateFilename), h.state)
+}
+
+// checkpoint saves the synchronization state while synchronizing
+func (h *Handler) checkpoint() {
+	source.Checkpoint(h.out, h.saveState)
+}
@@ -0,0 +1,197 @@
+package jmap
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/yzzyx/mr/source"
+)
+
+// defaultKeywordTags maps JMAP keywords to notmuch tags.
+// Tags prefixed with "-" are inverted, e.g. an email without the $seen keyword is tagged "unread"
+var defaultKeywordTags = map[string]string{
+	"$seen":     "-unread",
+	"$flagged":  "flagged",
+	"$answered": "replied",
+	"$draft":    "draft",
+}
+
+// defaultRoleTags maps the roles of mailboxes (RFC 8621, section 2) to notmuch tags.
+// Other mailboxes are represented by a tag with the same name as the mailbox.
+var defaultRoleTags = map[string]string{
+	"inbox":   "inbox",
+	"sent":    "sent",
+	"trash":   "trash",
+	"junk":    "spam",
+	"drafts":  "", // Represented by the $draft keyword
+	"archive": "", // Represented by the inbox tag not being set
+}
+
+// keywordMapping describes how a single keyword is represented as a notmuch tag
+type keywordMapping struct {
+	keyword  string
+	tag      string
+	inverted bool // tag is set when keyword is not set
+}
+
+// hasTag returns true if the keyword state should be represented by the tag being set
+func (km keywordMapping) hasTag(set bool) bool {
+	return set != km.inverted
+}
+
+// keywordMappings returns the list of keywords that should be synchronized,
+// based on the default mapping and the settings in KeywordTags
+func (h *Handler) keywordMappings() []keywordMapping {
+	keywordTags := make(map[string]string)
+	for keyword, tag := range defaultKeywordTags {
+		keywordTags[keyword] = tag
+	}
+	for keyword, tag := range h.account.KeywordTags {
+		keywordTags[strings.ToLower(keyword)] = tag
+	}
+
+	mappings := make([]keywordMapping, 0, len(keywordTags))
+	for keyword, tag := range keywordTags {
+		// Mappings can be disabled by setting an empty tag
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		km := keywordMapping{keyword: keyword, tag: tag}
+		if strings.HasPrefix(tag, "-") {
+			km.tag = tag[1:]
+			km.inverted = true
+		}
+		mappings = append(mappings, km)
+	}
+
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].keyword < mappings[j].keyword })
+	return mappings
+}
+
+// mailboxTag returns the notmuch tag representing a mailbox, or an empty string if the mailbox isn't synchronized
+func (h *Handler) mailboxTag(mb *mailbox) string {
+	if tag, ok := h.account.MailboxTags[mb.path]; ok {
+		return tag
+	}
+	if tag, ok := defaultRoleTags[mb.role]; ok {
+		return tag
+	}
+	return strings.ToLower(mb.path)
+}
+
+func setList(set map[string]bool) []string {
+	list := []string{}
+	for s, ok := range set {
+		if ok {
+			list = append(list, s)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// tagChanges are the tags that should be added to and removed from a message
+type tagChanges struct {
+	add    []string
+	remove []string
+}
+
+func (tc *tagChanges) update(tag string, set bool) {
+	if set {
+		tc.add = append(tc.add, tag)
+	} else {
+		tc.remove = append(tc.remove, tag)
+	}
+}
+
+// String returns the changes as e.g. "+inbox,-unread"
+func (tc *tagChanges) String() string {
+	var changes []string
+	for _, tag := range tc.add {
+		changes = append(changes, "+"+tag)
+	}
+	for _, tag := range tc.remove {
+		changes = append(changes, "-"+tag)
+	}
+	return strings.Join(changes, ",")
+}
+
+// merge performs a three-way merge of the keywords and mailboxes of an email.
+// 'remote' is the current state on the server, 'last' is the state when the email was last
+// synchronized, and 'tags' are the current tags of the local message.
+// It returns the merged state, the patch which updates the server (nil if nothing has changed),
+// and the tags that should be changed locally.
+func (h *Handler) merge(remote *emailState, last *emailState, tags map[string]bool) (*emailState, map[string]interface{}, *tagChanges) {
+	patch := make(map[string]interface{})
+	changes := &tagChanges{}
+
+	remoteKeywords := source.StringSet(remote.Keywords)
+	lastKeywords := source.StringSet(last.Keywords)
+	keywords := make(map[string]bool)
+	for _, km := range h.keywordMappings() {
+		local := tags[km.tag] == km.hasTag(true)
+		merged := source.MergeFlag(remoteKeywords[km.keyword], local, lastKeywords[km.keyword], last.Keywords != nil)
+		if merged != remoteKeywords[km.keyword] {
+			patch["keywords/"+km.keyword] = patchValue(merged)
+		}
+		if merged != local {
+			changes.update(km.tag, km.hasTag(merged))
+		}
+		keywords[km.keyword] = merged
+	}
+
+	remoteMailboxes := source.StringSet(remote.Mailboxes)
+	lastMailboxes := source.StringSet(last.Mailboxes)
+	mailboxes := make(map[string]bool)
+	for id := range remoteMailboxes {
+		mailboxes[id] = true
+	}
+	for _, id := range h.mailboxIDs() {
+		tag := h.mailboxTag(h.mailboxes[id])
+		if tag == "" {
+			// Mailboxes without a tag are left as they are on the server
+			continue
+		}
+		mailboxes[id] = source.MergeFlag(remoteMailboxes[id], tags[tag], lastMailboxes[id], last.Mailboxes != nil)
+	}
+
+	// An email must be in at least one mailbox. If the last tag has been removed, it's moved
+	// to the archive, if there is one, and otherwise left where it is.
+	if len(setList(mailboxes)) == 0 {
+		if archive := h.mailboxByRole("archive"); archive != "" {
+			mailboxes[archive] = true
+		} else {
+			mailboxes = remoteMailboxes
+		}
+	}
+
+	for _, id := range h.mailboxIDs() {
+		if mailboxes[id] != remoteMailboxes[id] {
+			patch["mailboxIds/"+id] = patchValue(mailboxes[id])
+		}
+		tag := h.mailboxTag(h.mailboxes[id])
+		if tag != "" && mailboxes[id] != tags[tag] {
+			changes.update(tag, mailboxes[id])
+		}
+	}
+
+	merged := &emailState{
+		MessageID: last.MessageID,
+		Folder:    last.Folder,
+		Keywords:  setList(keywords),
+		Mailboxes: setList(mailboxes),
+	}
+	if len(patch) == 0 {
+		patch = nil
+	}
+	return merged, patch, changes
+}
+
+// patchValue returns the value used in a patch to set (true) or unset (null) a keyword or mailbox
+func patchValue(set bool) interface{} {
+	if set {
+		return true
+	}
+	return nil
+}
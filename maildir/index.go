@@ -0,0 +1,102 @@
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yzzyx/mr/notmuch"
+)
+
+// scanDir compares the files in a directory with the files in the index. New files are added,
+// and removed files are returned in the scan. If the modification time of the directory is the
+// same as when it was last scanned, nothing has changed and nil is returned.
+func (h *Handler) scanDir(dir string) (*scan, error) {
+	s := &scan{path: dir}
+	info, err := os.Stat(dir)
+	if err == nil {
+		s.exists = true
+		s.mtime = info.ModTime()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	h.db.Lock()
+	defer h.db.Unlock()
+
+	d, st := h.db.GetDirectory(dir)
+	if d == nil {
+		return nil, fmt.Errorf("cannot read %s from index: %s", dir, st)
+	}
+	indexed := filenames(d.GetChildFiles())
+	unchanged := s.exists && d.GetMtime().Unix() == s.mtime.Unix()
+	d.Destroy()
+	if unchanged {
+		return nil, nil
+	}
+
+	onDisk := make(map[string]bool)
+	if s.exists {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			onDisk[entry.Name()] = true
+		}
+	}
+
+	isIndexed := make(map[string]bool, len(indexed))
+	for _, name := range indexed {
+		isIndexed[name] = true
+		if !onDisk[name] {
+			s.removed = append(s.removed, name)
+		}
+	}
+	for name := range onDisk {
+		if isIndexed[name] {
+			continue
+		}
+		err = h.addFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// addFile adds a file to the index. New messages get the initial tags of the account.
+func (h *Handler) addFile(path string) error {
+	m, st := h.db.AddMessage(path)
+	defer m.Destroy()
+
+	switch st {
+	case notmuch.STATUS_SUCCESS:
+		h.added++
+		for _, tag := range h.account.Tags {
+			if strings.HasPrefix(tag, "-") {
+				m.RemoveTag(tag[1:])
+			} else {
+				m.AddTag(tag)
+			}
+		}
+		if h.account.SyncFlags {
+			m.MaildirFlagsToTags()
+		}
+	case notmuch.STATUS_DUPLICATE_MESSAGE_ID:
+		// Either a copy of a message we already have, or a message which has been renamed or moved
+		if h.account.SyncFlags {
+			h.renamed = append(h.renamed, m.GetMessageId())
+		}
+	case notmuch.STATUS_FILE_NOT_EMAIL:
+		fmt.Fprintf(h.out, "skipping %s, since it's not an email\n", path)
+	default:
+		return fmt.Errorf("cannot add %s to index: %s", path, st)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+// Package maildir indexes local maildirs which are kept up to date by other programs,
+// such as fetchmail or mbsync
+package maildir
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/yzzyx/mr/config"
+	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
+)
+
+// Name used for a maildir stored directly in the directory of the account
+const rootFolder = "."
+
+// Tags added to new messages, unless they're set in the configuration
+var defaultTags = []string{"inbox", "unread"}
+
+// Account defines the available options for a local maildir account
+type Account struct {
+	// Tags added to new messages (defaults to inbox and unread)
+	Tags []string
+
+	// Set tags from the maildir flags of new and renamed files, e.g. remove "unread" from
+	// messages marked as seen
+	SyncFlags bool `yaml:"sync_flags"`
+}
+
+// scan is a directory which has been scanned for new files, and the files which have been removed from it
+type scan struct {
+	path    string
+	mtime   time.Time
+	exists  bool
+	removed []string
+}
+
+// Handler indexes the maildirs in the directory of a single account
+type Handler struct {
+	db      *notmuch.Database
+	path    string
+	account Account
+
+	// Progress information is written to out
+	out io.Writer
+
+	// Start of the current pass, scanned directories by folder, and the message ids of
+	// messages which have been added again under a different name
+	started time.Time
+	scans   map[string][]*scan
+	renamed []string
+
+	added   int
+	removed int
+}
+
+func init() {
+	source.Register("maildir", newSource)
+}
+
+// newSource creates a handler from the configuration of an account
+func newSource(db *notmuch.Database, path string, account *config.Account) (source.MailSource, error) {
+	var a Account
+	err := account.Decode(&a)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, path, a), nil
+}
+
+// New creates a new Handler, indexing the maildirs in 'path'
+func New(db *notmuch.Database, path string, account Account) *Handler {
+	if account.Tags == nil {
+		account.Tags = defaultTags
+	}
+	return &Handler{
+		db:      db,
+		path:    path,
+		account: account,
+		out:     os.Stdout,
+	}
+}
+
+// SetOutput sets the destination of progress information (defaults to os.Stdout)
+func (h *Handler) SetOutput(w io.Writer) {
+	h.out = w
+}
+
+// Close does nothing, since the state is kept in the notmuch database
+func (h *Handler) Close() error {
+	return nil
+}
+
+// Connect starts a new indexing pass
+func (h *Handler) Connect() error {
+	h.started = time.Now()
+	h.scans = make(map[string][]*scan)
+	h.renamed = nil
+	h.added = 0
+	h.removed = 0
+	return nil
+}
+
+// Disconnect updates the tags of renamed messages from their maildir flags, once the old
+// filenames have been removed, and reports what has changed
+func (h *Handler) Disconnect() {
+	if h.account.SyncFlags && len(h.renamed) > 0 {
+		h.db.Lock()
+		for _, messageID := range h.renamed {
+			m, st := h.db.FindMessage(messageID)
+			if m == nil || st != notmuch.STATUS_SUCCESS {
+				continue
+			}
+			m.MaildirFlagsToTags()
+			m.Destroy()
+		}
+		h.db.Unlock()
+	}
+
+	if h.added > 0 || h.removed > 0 {
+		fmt.Fprintf(h.out, "indexed %s: %d new, %d removed\n", h.path, h.added, h.removed)
+	}
+	h.scans = nil
+	h.renamed = nil
+}
+
+// ListFolders returns the maildirs in the directory of the account, and the maildirs
+// which are still in the index but have been removed
+func (h *Handler) ListFolders() ([]string, error) {
+	folders := make(map[string]bool)
+	err := h.diskFolders(h.path, folders)
+	if err != nil {
+		return nil, err
+	}
+
+	h.db.Lock()
+	h.indexedFolders(h.path, folders)
+	h.db.Unlock()
+
+	list := make([]string, 0, len(folders))
+	for folder := range folders {
+		list = append(list, folder)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// folderName returns the name of the folder stored in a directory
+func (h *Handler) folderName(dir string) string {
+	rel, err := filepath.Rel(h.path, dir)
+	if err != nil || rel == "." {
+		return rootFolder
+	}
+	return filepath.ToSlash(rel)
+}
+
+// isMaildirDir returns true if 'name' is one of the subdirectories of a maildir
+func isMaildirDir(name string) bool {
+	return name == "cur" || name == "new" || name == "tmp"
+}
+
+// diskFolders adds the maildirs found in 'dir' and its subdirectories to 'folders'.
+// Folders in the maildir++ layout start with a dot, so only the notmuch database is skipped.
+func (h *Handler) diskFolders(dir string, folders map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) && dir == h.path {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || name == ".notmuch" {
+			continue
+		}
+		if isMaildirDir(name) {
+			if name != "tmp" {
+				folders[h.folderName(dir)] = true
+			}
+			continue
+		}
+
+		err = h.diskFolders(filepath.Join(dir, name), folders)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexedFolders adds the maildirs in the index found in 'dir' and its subdirectories to 'folders'
+func (h *Handler) indexedFolders(dir string, folders map[string]bool) {
+	d, _ := h.db.GetDirectory(dir)
+	if d == nil {
+		return
+	}
+	children := filenames(d.GetChildDirectories())
+	d.Destroy()
+
+	for _, name := range children {
+		if isMaildirDir(name) {
+			if name != "tmp" {
+				folders[h.folderName(dir)] = true
+			}
+			continue
+		}
+		h.indexedFolders(filepath.Join(dir, name), folders)
+	}
+}
+
+// filenames returns the names in a notmuch filename list
+func filenames(it *notmuch.Filenames) []string {
+	var names []string
+	for it.Valid() {
+		names = append(names, it.Get())
+		it.MoveToNext()
+	}
+	it.Destroy()
+	return names
+}
+
+// folderPath returns the directory where a folder is stored
+func (h *Handler) folderPath(folder string) string {
+	return filepath.Join(h.path, filepath.FromSlash(folder))
+}
+
+// FetchNew adds new files in a folder to the index. Files which have been removed are
+// only removed from the index by PushChanges, once all folders have been scanned, so that
+// messages which have been moved to another folder keep their tags.
+func (h *Handler) FetchNew(folder string) error {
+	for _, sub := range []string{"new", "cur"} {
+		s, err := h.scanDir(filepath.Join(h.folderPath(folder), sub))
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			h.scans[folder] = append(h.scans[folder], s)
+		}
+	}
+	return nil
+}
+
+// PushChanges removes files which are no longer in a folder from the index, and stores the
+// modification times of its directories, so that they're skipped if they haven't changed
+func (h *Handler) PushChanges(folder string) error {
+	h.db.Lock()
+	defer h.db.Unlock()
+
+	for _, s := range h.scans[folder] {
+		for _, name := range s.removed {
+			st := h.db.RemoveMessage(filepath.Join(s.path, name))
+			switch st {
+			case notmuch.STATUS_SUCCESS:
+				h.removed++
+			case notmuch.STATUS_DUPLICATE_MESSAGE_ID:
+				// The message is still available under another name
+			default:
+				return fmt.Errorf("cannot remove %s from index: %s", filepath.Join(s.path, name), st)
+			}
+		}
+
+		d, st := h.db.GetDirectory(s.path)
+		if d == nil {
+			return fmt.Errorf("cannot read %s from index: %s", s.path, st)
+		}
+		if !s.exists {
+			st = d.Delete()
+		} else if s.mtime.Unix() < h.started.Unix() {
+			// Files added within the same second as the scan could be missed,
+			// in which case the directory is scanned again the next time
+			st = d.SetMtime(s.mtime)
+			d.Destroy()
+		} else {
+			d.Destroy()
+		}
+		if st != notmuch.STATUS_SUCCESS {
+			return fmt.Errorf("cannot update %s in index: %s", s.path, st)
+		}
+	}
+	delete(h.scans, folder)
+	return nil
+}
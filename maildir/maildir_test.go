@@ -0,0 +1,106 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yzzyx/mr/internal/testutil"
+	"github.com/yzzyx/mr/source"
+)
+
+// writeMessage writes a message with a specific message id to a file
+func writeMessage(t *testing.T, path string, messageID string) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "From: sender@example.org\n" +
+		"Subject: Message " + messageID + "\n" +
+		"Message-ID: <" + messageID + ">\n" +
+		"\n" +
+		"Hello\n"
+	err = ioutil.WriteFile(path, []byte(body), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskFolders(t *testing.T) {
+	path, cleanup := testutil.TempDir(t)
+	defer cleanup()
+
+	for _, dir := range []string{"cur", "INBOX/new", "INBOX/Lists/cur", ".Sent/cur", ".notmuch/xapian", "Other"} {
+		err := os.MkdirAll(filepath.Join(path, dir), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := New(nil, path, Account{})
+	folders := make(map[string]bool)
+	err := h.diskFolders(path, folders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{".": true, "INBOX": true, "INBOX/Lists": true, ".Sent": true}
+	if !reflect.DeepEqual(folders, expected) {
+		t.Errorf("expected folders %v, got %v", expected, folders)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	td := testutil.NewDatabase(t)
+	defer td.Close()
+	db, root, tags := td.DB, td.Path, td.Tags
+
+	path := filepath.Join(root, "local")
+	writeMessage(t, filepath.Join(path, "INBOX", "new", "1"), "1@example.org")
+	writeMessage(t, filepath.Join(path, "INBOX", "cur", "2:2,S"), "2@example.org")
+
+	h := New(db, path, Account{SyncFlags: true})
+	h.SetOutput(ioutil.Discard)
+	err := source.Sync(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := tags("1@example.org"); !tags["inbox"] || !tags["unread"] {
+		t.Errorf("expected first message to be tagged inbox and unread, got %v", tags)
+	}
+	if tags := tags("2@example.org"); !tags["inbox"] || tags["unread"] {
+		t.Errorf("expected second message to be tagged inbox, got %v", tags)
+	}
+
+	// Messages keep their tags when they're moved to another folder, and are removed when they're deleted
+	db.Lock()
+	m, _ := db.FindMessage("1@example.org")
+	m.AddTag("important")
+	m.Destroy()
+	db.Unlock()
+
+	err = os.MkdirAll(filepath.Join(path, "Archive", "cur"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(filepath.Join(path, "INBOX", "new", "1"), filepath.Join(path, "Archive", "cur", "1:2,S"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(path, "INBOX", "cur", "2:2,S"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = source.Sync(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := tags("1@example.org"); !tags["important"] || tags["unread"] {
+		t.Errorf("expected moved message to keep its tags and be read, got %v", tags)
+	}
+	if tags := tags("2@example.org"); tags != nil {
+		t.Errorf("expected deleted message to be removed, got tags %v", tags)
+	}
+}
@@ -1,110 +1,43 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"runtime"
-	"strings"
-	"time"
 
 	"github.com/yzzyx/mr/config"
-	"github.com/yzzyx/mr/imap"
 	"github.com/yzzyx/mr/models"
 	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
 	"github.com/yzzyx/mr/ui"
 	"gopkg.in/yaml.v2"
 )
 
-func indexAllFiles(db *notmuch.Database, lastRuntime time.Time, dirpath string) error {
-	fd, err := os.Open(dirpath)
-	if err != nil {
-		panic(err)
-	}
-	defer fd.Close()
-
-	var entries []os.FileInfo
-	for {
-		entries, err = fd.Readdir(5)
-		if err != nil && err != io.EOF {
-			return err
-		}
-
-		if len(entries) == 0 {
-			break
-		}
-
-		for k := range entries {
-			name := entries[k].Name()
-			if strings.HasPrefix(name, ".") {
-				continue
-			}
+func main() {
 
-			newPath := filepath.Join(dirpath, name)
-			if entries[k].IsDir() {
-				err = indexAllFiles(db, lastRuntime, newPath)
-				if err != nil {
-					return err
-				}
-			} else if entries[k].ModTime().After(lastRuntime) {
-				m, st := db.AddMessage(newPath)
-				// We've already seen this one
-				if st == notmuch.STATUS_DUPLICATE_MESSAGE_ID {
-					continue
-				}
-				if st != notmuch.STATUS_SUCCESS {
-					return errors.New(st.String())
-				}
-				fmt.Println(newPath)
-				m.Destroy()
-			}
-		}
-	}
-	return nil
-}
+	var db *notmuch.Database
+	var status notmuch.Status
 
-func userHomeDir() string {
-	if runtime.GOOS == "windows" {
-		home := os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
-		if home == "" {
-			home = os.Getenv("USERPROFILE")
+	// Commands which run instead of the UI
+	commands := map[string]func(db *notmuch.Database, cfg config.Config, maildirPath string, args []string) error{
+		"index":  indexAccounts,
+		"import": importMbox,
+		"export": exportMbox,
+		"dedupe": dedupeMessages,
+	}
+	var command func(db *notmuch.Database, cfg config.Config, maildirPath string, args []string) error
+	if len(os.Args) > 1 {
+		var ok bool
+		command, ok = commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %s\nusage: mr [index | import mbox <file> | export mbox <query> <file> | dedupe [--remove [--force]] [query]]\n", os.Args[1])
+			os.Exit(2)
 		}
-		return home
-	}
-	return os.Getenv("HOME")
-}
-
-func parsePathSetting(inPath string) string {
-	if strings.HasPrefix(inPath, "$HOME") {
-		inPath = userHomeDir() + inPath[5:]
-	} else if strings.HasPrefix(inPath, "~/") {
-		inPath = userHomeDir() + inPath[1:]
-	}
-
-	if strings.HasPrefix(inPath, "$") {
-		end := strings.Index(inPath, string(os.PathSeparator))
-		inPath = os.Getenv(inPath[1:end]) + inPath[end:]
-	}
-	if filepath.IsAbs(inPath) {
-		return filepath.Clean(inPath)
-	}
-
-	p, err := filepath.Abs(inPath)
-	if err == nil {
-		return filepath.Clean(p)
 	}
-	return ""
-}
 
-func main() {
-
-	var db *notmuch.Database
-	var status notmuch.Status
-	configPath := filepath.Join(userHomeDir(), ".config", "mr")
+	configPath := filepath.Join(config.HomeDir(), ".config", "mr")
 
 	cfgdata, err := ioutil.ReadFile("./config.yml")
 	if err != nil {
@@ -123,7 +56,7 @@ func main() {
 		cfg.Maildir = "~/.mail"
 	}
 
-	maildirPath := parsePathSetting(cfg.Maildir)
+	maildirPath := config.ExpandPath(cfg.Maildir)
 
 	// Create maildir if it doesnt exist
 	err = os.MkdirAll(maildirPath, 0700)
@@ -147,71 +80,131 @@ func main() {
 		return
 	}
 
-	//ts := time.Time{}
-	//lastIndexedPath := filepath.Join(configPath, "lastindexed")
-	//data, err := ioutil.ReadFile(lastIndexedPath)
-	//if err == nil {
-	//	err = json.Unmarshal(data, &ts)
-	//	if err != nil {
-	//		fmt.Println("Cannot unmarshal last index date:", err)
-	//		return
-	//	}
-	//}
-
-	//now := time.Now()
-
-	// FIXME - Wrap this in a command
-	// Reindex all files
-	//fmt.Println("Indexing mailfiles...")
-	//err = indexAllFiles(db, ts, maildirPath)
-	//if err != nil {
-	//	fmt.Println("Could not index maildir:", err)
-	//	return
-	//}
-
-	//data, err = json.Marshal(now)
-	//if err == nil {
-	//	err = ioutil.WriteFile(lastIndexedPath, data, 0600)
-	//	if err != nil {
-	//		fmt.Println("Could not update last indexed timestamp:", err)
-	//		return
-	//	}
-	//}
-
-	//if h.cfg.IndexedMailDir == false {
-	//	err = indexAllFiles(db, time.Time{}, h.maildirPath)
-	//	if err != nil {
-	//		return nil, err
-	//	}
-	//}
-
-	// Create a IMAP setup for each mailbox
-	for name, mailbox := range cfg.Mailboxes {
+	if command != nil {
+		err = command(db, cfg, maildirPath, os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Signals the UI that new mail has arrived
+	refresh := make(chan struct{}, 1)
+	var logFile *os.File
+	var sources []source.MailSource
+	defer func() {
+		// The sources are closed before the log file, since their watchers may still write to it
+		for _, s := range sources {
+			err := s.Close()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		if logFile != nil {
+			logFile.Close()
+		}
+	}()
+
+	// Create a source for each account
+	for name, account := range cfg.Mailboxes {
 		folderPath := filepath.Join(maildirPath, name)
 		err = os.MkdirAll(folderPath, 0700)
 		if err != nil {
 			panic(err)
 		}
 
-		h, err := imap.New(db, folderPath, mailbox)
+		s, err := source.New(db, folderPath, &account)
+		if err == source.ErrLocked {
+			// Another instance is already keeping this account up to date
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			continue
+		}
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("%s: %s", name, err)
 		}
-		defer h.Close()
+		sources = append(sources, s)
 
-		err = h.CheckMessages()
+		// Failing to synchronize isn't fatal, since the messages we already have can still be read
+		err = source.Sync(s)
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		}
+
+		if w, ok := s.(source.Watcher); ok && w.Watching() {
+			// Progress information would garble the UI, so write it to a logfile instead
+			if logFile == nil {
+				logFile, err = os.OpenFile(filepath.Join(maildirPath, ".mr.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			s.SetOutput(logFile)
+			w.Watch(refresh)
 		}
 	}
 
+	// Push tag changes made in the UI to the servers
+	models.OnTagsChanged(func() {
+		for _, s := range sources {
+			if w, ok := s.(source.Watcher); ok {
+				w.RequestSync()
+			}
+		}
+	})
+
+	// Move messages to other folders on the servers
+	models.OnMoveMessages(func(messageIDs []string, folder string) error {
+		remaining := messageIDs
+		for _, s := range sources {
+			m, ok := s.(source.Mover)
+			if !ok || len(remaining) == 0 {
+				continue
+			}
+			found, err := m.Move(remaining, folder)
+			if err != nil {
+				return err
+			}
+
+			moved := make(map[string]bool, len(found))
+			for _, messageID := range found {
+				moved[messageID] = true
+			}
+			var left []string
+			for _, messageID := range remaining {
+				if !moved[messageID] {
+					left = append(left, messageID)
+				}
+			}
+			remaining = left
+		}
+		if len(remaining) > 0 {
+			return fmt.Errorf("%d message(s) not found on any server", len(remaining))
+		}
+		return nil
+	})
+	models.OnFetchBody(func(messageID string) (string, error) {
+		for _, s := range sources {
+			f, ok := s.(source.BodyFetcher)
+			if !ok {
+				continue
+			}
+			filename, err := f.FetchBody(messageID)
+			if filename != "" || err != nil {
+				return filename, err
+			}
+		}
+		return "", fmt.Errorf("message %s not found on any server", messageID)
+	})
+
 	err = models.Setup(db)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "cannot setup models:", err)
 		return
 	}
 
-	err = ui.Setup()
+	err = ui.Setup(refresh)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error in ui:", err)
 		return
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yzzyx/mr/config"
+	"github.com/yzzyx/mr/mbox"
+	"github.com/yzzyx/mr/notmuch"
+)
+
+// parseArgs parses flags which may appear anywhere among the positional arguments,
+// and returns the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// importMbox implements "mr import mbox <file> [--folder X] [--tags a,b] [--format mboxrd|mboxo]",
+// which stores the messages in an mbox file as maildir files, and adds them to the index
+func importMbox(db *notmuch.Database, cfg config.Config, maildirPath string, args []string) error {
+	fs := flag.NewFlagSet("import mbox", flag.ContinueOnError)
+	folder := fs.String("folder", "import", "folder in the maildir where messages are stored")
+	tagList := fs.String("tags", "", "comma separated list of tags added to the messages")
+	formatName := fs.String("format", "mboxrd", "quoting of From lines, mboxrd or mboxo")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 || positional[0] != "mbox" {
+		return errors.New("usage: mr import mbox <file> [--folder X] [--tags a,b] [--format mboxrd|mboxo]")
+	}
+	format, err := mbox.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(*tagList, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	folderPath := filepath.Join(maildirPath, filepath.FromSlash(*folder))
+	if !strings.HasPrefix(folderPath, maildirPath+string(filepath.Separator)) {
+		return fmt.Errorf("folder %s is outside the maildir", *folder)
+	}
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		err = os.MkdirAll(filepath.Join(folderPath, dir), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	fd, err := os.Open(positional[1])
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	imported, duplicates := 0, 0
+	r := mbox.NewReader(fd, format)
+	for seqNum := 1; ; seqNum++ {
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		filename := fmt.Sprintf("%d_%d.%d.%s:2,", time.Now().Unix(), seqNum, os.Getpid(), hostname)
+		tmpPath := filepath.Join(folderPath, "tmp", filename)
+		path := filepath.Join(folderPath, "cur", filename)
+		err = ioutil.WriteFile(tmpPath, msg, 0600)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmpPath, path)
+		if err != nil {
+			_ = os.Remove(tmpPath)
+			return err
+		}
+
+		added, err := addImportedMessage(db, path, tags)
+		if err != nil {
+			return err
+		}
+		if added {
+			imported++
+		} else {
+			duplicates++
+		}
+	}
+
+	fmt.Printf("imported %d messages into %s", imported, *folder)
+	if duplicates > 0 {
+		fmt.Printf(", skipped %d messages which were already in the index", duplicates)
+	}
+	fmt.Println()
+	return nil
+}
+
+// addImportedMessage adds a message file to the index, and tags it. Messages that are
+// already in the index are removed again, and false is returned.
+func addImportedMessage(db *notmuch.Database, path string, tags []string) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	m, st := db.AddMessage(path)
+	defer m.Destroy()
+	switch st {
+	case notmuch.STATUS_SUCCESS:
+		for _, tag := range tags {
+			m.AddTag(tag)
+		}
+		return true, nil
+	case notmuch.STATUS_DUPLICATE_MESSAGE_ID:
+		db.RemoveMessage(path)
+		return false, os.Remove(path)
+	}
+
+	_ = os.Remove(path)
+	return false, fmt.Errorf("cannot add message to index: %s", st)
+}
+
+// exportMbox implements "mr export mbox <query> <file>", which writes the messages matching
+// a notmuch query to an mbox file, oldest first. The file "-" is standard output.
+func exportMbox(db *notmuch.Database, cfg config.Config, maildirPath string, args []string) error {
+	if len(args) != 3 || args[0] != "mbox" {
+		return errors.New("usage: mr export mbox <query> <file>")
+	}
+	query, path := args[1], args[2]
+
+	var out io.Writer = os.Stdout
+	var fd *os.File
+	if path != "-" {
+		var err error
+		fd, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		// Only used if the export fails, the file is closed below otherwise
+		defer fd.Close()
+		out = fd
+	}
+
+	type message struct {
+		filename string
+		date     time.Time
+	}
+	var messages []message
+
+	db.Lock()
+	q := db.CreateQuery(query)
+	q.SetSort(notmuch.SORT_OLDEST_FIRST)
+	it := q.SearchMessages()
+	for it.Valid() {
+		m := it.Get()
+		msg := message{filename: m.GetFileName()}
+		if timestamp, st := m.GetDate(); st == notmuch.STATUS_SUCCESS {
+			msg.date = time.Unix(timestamp, 0)
+		}
+		messages = append(messages, msg)
+		it.MoveToNext()
+	}
+	it.Destroy()
+	q.Destroy()
+	db.Unlock()
+
+	w := mbox.NewWriter(out)
+	for _, msg := range messages {
+		data, err := ioutil.ReadFile(msg.filename)
+		if err != nil {
+			return err
+		}
+		err = w.WriteMessage(data, msg.date)
+		if err != nil {
+			return err
+		}
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Errors from writing to the file may only be reported when it's synced or closed
+	if fd != nil {
+		err = fd.Sync()
+		if err != nil {
+			return err
+		}
+		err = fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d messages\n", len(messages))
+	return nil
+}
@@ -0,0 +1,204 @@
+// Package mbox reads and writes messages in the mbox format (RFC 4155)
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Format describes how lines starting with "From " in message bodies are quoted
+type Format int
+
+const (
+	// MboxRD quotes "From " lines by adding a ">", also to lines which are already quoted,
+	// e.g. ">From " becomes ">>From ". The quoting can be reversed exactly.
+	MboxRD Format = iota
+	// MboxO only quotes "From " lines, so ">From " lines can't be told apart from quoted lines.
+	// This is the format used by Thunderbird and many older programs.
+	MboxO
+)
+
+// ParseFormat returns the format with a specific name, either "mboxrd" or "mboxo"
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "mboxrd":
+		return MboxRD, nil
+	case "mboxo":
+		return MboxO, nil
+	}
+	return 0, fmt.Errorf("unknown mbox format %s, expected mboxrd or mboxo", name)
+}
+
+// Reader splits an mbox file into messages
+type Reader struct {
+	r      *bufio.Reader
+	format Format
+
+	// The "From " line of the next message, which has already been read
+	next []byte
+	err  error
+}
+
+// NewReader returns a reader of messages in an mbox file
+func NewReader(r io.Reader, format Format) *Reader {
+	return &Reader{r: bufio.NewReader(r), format: format}
+}
+
+// readLine returns the next line including its line ending, or nil and an error at the end of the file
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	if len(line) > 0 {
+		return line, nil
+	}
+	return nil, err
+}
+
+// isFromLine returns true if a line is the first line of a message
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// unquote removes the quoting from a line in the body of a message
+func (r *Reader) unquote(line []byte) []byte {
+	if r.format == MboxO {
+		if bytes.HasPrefix(line, []byte(">From ")) {
+			return line[1:]
+		}
+		return line
+	}
+
+	quoted := bytes.TrimLeft(line, ">")
+	if len(quoted) < len(line) && isFromLine(quoted) {
+		return line[1:]
+	}
+	return line
+}
+
+// Next returns the next message, without its "From " line. Line endings are converted to "\n".
+// io.EOF is returned when there are no more messages.
+func (r *Reader) Next() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if r.next == nil {
+		// Skip anything before the first message
+		for {
+			line, err := r.readLine()
+			if err != nil {
+				r.err = err
+				return nil, err
+			}
+			if isFromLine(line) {
+				r.next = line
+				break
+			}
+		}
+	}
+
+	var msg bytes.Buffer
+	r.next = nil
+	blank := false
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			r.err = err
+			if err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		// A message ends with a blank line, followed by the "From " line of the next message
+		if blank && isFromLine(line) {
+			r.next = line
+			break
+		}
+		if blank {
+			msg.WriteByte('\n')
+		}
+		if len(line) == 0 {
+			blank = true
+			continue
+		}
+		blank = false
+
+		msg.Write(r.unquote(line))
+		msg.WriteByte('\n')
+	}
+
+	// The blank line before the next message is part of the mbox format, but the message may
+	// have ended with more blank lines, which have been written except for the last one
+	if msg.Len() == 0 && r.err == io.EOF {
+		return nil, io.EOF
+	}
+	return msg.Bytes(), nil
+}
+
+// Writer writes messages to an mbox file, in the mboxrd format
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a writer of messages to an mbox file. Flush must be called when all messages
+// have been written.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// fromLineSender returns the address used in the "From " line of a message, based on its From header
+func fromLineSender(msg []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err == nil {
+		addrs, err := m.Header.AddressList("From")
+		if err == nil && len(addrs) > 0 && !strings.ContainsAny(addrs[0].Address, " \t") {
+			return addrs[0].Address
+		}
+	}
+	return "MAILER-DAEMON"
+}
+
+// WriteMessage writes a message, which was received at 'date'. Lines starting with "From ",
+// possibly quoted with ">", are quoted with an additional ">".
+func (w *Writer) WriteMessage(msg []byte, date time.Time) error {
+	_, err := fmt.Fprintf(w.w, "From %s %s\n", fromLineSender(msg), date.UTC().Format(time.ANSIC))
+	if err != nil {
+		return err
+	}
+
+	lines := bytes.Split(msg, []byte("\n"))
+	// Skip the empty string after the final newline
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		line = bytes.TrimRight(line, "\r")
+		if isFromLine(bytes.TrimLeft(line, ">")) {
+			err = w.w.WriteByte('>')
+			if err != nil {
+				return err
+			}
+		}
+		_, err = w.w.Write(line)
+		if err == nil {
+			err = w.w.WriteByte('\n')
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Messages are separated by a blank line
+	return w.w.WriteByte('\n')
+}
+
+// Flush writes any buffered data to the underlying writer
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
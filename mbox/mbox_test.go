@@ -0,0 +1,110 @@
+package mbox
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAll returns all messages in an mbox file
+func readAll(t *testing.T, data string, format Format) []string {
+	r := NewReader(strings.NewReader(data), format)
+	var messages []string
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, string(msg))
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := "From alice@example.org Thu Jan  1 00:00:00 2015\n" +
+		"Subject: first\n" +
+		"\n" +
+		"Hello\n" +
+		">From the start\n" +
+		">>From quoted\n" +
+		"From inside a paragraph isn't a separator\n" +
+		"\n" +
+		"From bob@example.org Thu Jan  1 00:00:00 2015\r\n" +
+		"Subject: second\r\n" +
+		"\r\n" +
+		"Trailing blank line\r\n" +
+		"\r\n" +
+		"\r\n"
+
+	tests := []struct {
+		format   Format
+		expected []string
+	}{
+		{
+			format: MboxRD,
+			expected: []string{
+				"Subject: first\n\nHello\nFrom the start\n>From quoted\nFrom inside a paragraph isn't a separator\n",
+				"Subject: second\n\nTrailing blank line\n\n",
+			},
+		},
+		{
+			format: MboxO,
+			expected: []string{
+				"Subject: first\n\nHello\nFrom the start\n>>From quoted\nFrom inside a paragraph isn't a separator\n",
+				"Subject: second\n\nTrailing blank line\n\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		messages := readAll(t, data, test.format)
+		if !reflect.DeepEqual(messages, test.expected) {
+			t.Errorf("format %d: expected %q, got %q", test.format, test.expected, messages)
+		}
+	}
+
+	if messages := readAll(t, "", MboxRD); len(messages) != 0 {
+		t.Errorf("expected no messages in empty file, got %q", messages)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	messages := []string{
+		"From: Alice <alice@example.org>\nSubject: first\n\nFrom here\n>From there\n",
+		"Subject: second\r\n\r\nNo sender\r\n\r\n",
+	}
+	date := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, msg := range messages {
+		err := w.WriteMessage([]byte(msg), date)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From alice@example.org Fri Jan  2 03:04:05 2015\n" +
+		"From: Alice <alice@example.org>\nSubject: first\n\n>From here\n>>From there\n\n" +
+		"From MAILER-DAEMON Fri Jan  2 03:04:05 2015\n" +
+		"Subject: second\n\nNo sender\n\n\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	// Messages are read back as they were written, with "\n" line endings
+	read := readAll(t, buf.String(), MboxRD)
+	messages[1] = strings.Replace(messages[1], "\r\n", "\n", -1)
+	if !reflect.DeepEqual(read, messages) {
+		t.Errorf("expected %q, got %q", messages, read)
+	}
+}
@@ -1,10 +1,51 @@
 package models
 
-import "time"
+import (
+	"errors"
+	"os"
+	"time"
+)
 
 // Message describes a single message
 type Message struct {
-	ID       string
-	Filename string
-	Date     time.Time
+	ID        string
+	Filename  string
+	Filenames []string // All files containing the message, when it has been stored in several folders
+	Date      time.Time
+	Partial   bool // Only the headers of the message have been downloaded
+}
+
+// FetchBody downloads the full message if only the headers have been downloaded
+func (m *Message) FetchBody() error {
+	if !m.Partial {
+		return nil
+	}
+	if fetchBody == nil {
+		return errors.New("downloading messages is not supported")
+	}
+
+	filename, err := fetchBody(m.ID)
+	if err != nil {
+		return err
+	}
+	m.Filename = filename
+	m.Partial = false
+	return nil
+}
+
+// BestFilename returns the file which is best suited for reading the message.
+// When the message has been stored more than once, the largest file which still
+// exists is used, so that a complete copy is preferred to one with only the headers.
+func (m *Message) BestFilename() string {
+	best := m.Filename
+	var bestSize int64 = -1
+	for _, filename := range append([]string{m.Filename}, m.Filenames...) {
+		fi, err := os.Stat(filename)
+		if err != nil || fi.Size() <= bestSize {
+			continue
+		}
+		best = filename
+		bestSize = fi.Size()
+	}
+	return best
 }
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBestFilename(t *testing.T) {
+	path, err := ioutil.TempDir("", "mr-models-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	headers := filepath.Join(path, "headers")
+	full := filepath.Join(path, "full")
+	missing := filepath.Join(path, "missing")
+	err = ioutil.WriteFile(headers, []byte("Subject: test\r\n\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(full, []byte("Subject: test\r\n\r\nThe body of the message\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename  string
+		filenames []string
+		expected  string
+	}{
+		{headers, nil, headers},
+		// The larger file is preferred
+		{headers, []string{headers, full}, full},
+		{full, []string{headers, full}, full},
+		// Missing files are skipped, even if it's the main file
+		{missing, []string{missing, headers}, headers},
+		{headers, []string{missing, headers}, headers},
+		// If no file exists, the main file is returned
+		{missing, []string{missing}, missing},
+	}
+
+	for _, test := range tests {
+		m := Message{Filename: test.filename, Filenames: test.filenames}
+		if best := m.BestFilename(); best != test.expected {
+			t.Errorf("%s %v: expected %s, got %s", test.filename, test.filenames, test.expected, best)
+		}
+	}
+}
@@ -3,7 +3,10 @@ package models
 import "github.com/yzzyx/mr/notmuch"
 
 var (
-	notmuchDB *notmuch.Database
+	notmuchDB    *notmuch.Database
+	tagsChanged  func()
+	moveMessages func(messageIDs []string, folder string) error
+	fetchBody    func(messageID string) (string, error)
 )
 
 // Setup initializes the global notmuch-database
@@ -11,3 +14,19 @@ func Setup(db *notmuch.Database) error {
 	notmuchDB = db
 	return nil
 }
+
+// OnTagsChanged registers a function which is called each time tags have been saved
+func OnTagsChanged(f func()) {
+	tagsChanged = f
+}
+
+// OnMoveMessages registers the function used to move messages to another folder
+func OnMoveMessages(f func(messageIDs []string, folder string) error) {
+	moveMessages = f
+}
+
+// OnFetchBody registers the function used to download the body of messages where only
+// the headers have been downloaded. It returns the path of the updated message file.
+func OnFetchBody(f func(messageID string) (string, error)) {
+	fetchBody = f
+}
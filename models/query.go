@@ -3,6 +3,7 @@ package models
 import (
 	"time"
 
+	"github.com/yzzyx/mr/internal/tagnames"
 	"github.com/yzzyx/mr/notmuch"
 )
 
@@ -21,6 +22,8 @@ func NewQuery(query string) *Query {
 // Count returns the matching query count
 func (m *Query) Count() int {
 	if m.count == 0 {
+		notmuchDB.Lock()
+		defer notmuchDB.Unlock()
 		q := notmuchDB.CreateQuery(m.query)
 		defer q.Destroy()
 		m.count = int(q.CountThreads())
@@ -43,6 +46,8 @@ func (m *Query) GetLine(lineNumber int) Thread {
 
 // GetList returns the threads available between 'from' and 'to'
 func (m *Query) GetList(from, to int) []Thread {
+	notmuchDB.Lock()
+	defer notmuchDB.Unlock()
 	q := notmuchDB.CreateQuery(m.query)
 	defer q.Destroy()
 
@@ -80,6 +85,21 @@ func (m *Query) GetList(from, to int) []Thread {
 				Filename: m.GetFileName(),
 			}
 
+			filenames := m.GetFileNames()
+			for filenames.Valid() {
+				message.Filenames = append(message.Filenames, filenames.Get())
+				filenames.MoveToNext()
+			}
+			filenames.Destroy()
+
+			messageTags := m.GetTags()
+			for messageTags.Valid() {
+				if messageTags.Get() == tagnames.Partial {
+					message.Partial = true
+				}
+				messageTags.MoveToNext()
+			}
+
 			messageTimestamp, status := m.GetDate()
 			if status == notmuch.STATUS_SUCCESS {
 				message.Date = time.Unix(messageTimestamp, 0)
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"errors"
 	"time"
 
 	"github.com/yzzyx/mr/notmuch"
@@ -19,6 +20,14 @@ type Thread struct {
 
 // SaveTags synchronizes the tags for a thread to disk
 func (t Thread) SaveTags() {
+	if tagsChanged != nil {
+		// Deferred first, so that it's called after the database has been unlocked
+		defer tagsChanged()
+	}
+
+	notmuchDB.Lock()
+	defer notmuchDB.Unlock()
+
 	for _, msg := range t.Messages {
 		m, status := notmuchDB.FindMessage(msg.ID)
 		if status != notmuch.STATUS_SUCCESS {
@@ -43,7 +52,23 @@ func (t Thread) SaveTags() {
 		for tag := range currentTags {
 			m.RemoveTag(tag)
 		}
+
+		// Keep the maildir flags in the filenames in sync with the tags
+		m.TagsToMaildirFlags()
+	}
+}
+
+// Move moves all messages in a thread to another folder
+func (t Thread) Move(folder string) error {
+	if moveMessages == nil {
+		return errors.New("moving messages is not supported")
+	}
+
+	messageIDs := make([]string, 0, len(t.Messages))
+	for _, msg := range t.Messages {
+		messageIDs = append(messageIDs, msg.ID)
 	}
+	return moveMessages(messageIDs, folder)
 }
 
 // HasTag returns true if thread has a specific tag set
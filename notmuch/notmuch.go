@@ -12,6 +12,8 @@ package notmuch
 */
 import "C"
 import (
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -51,6 +53,10 @@ func (self Status) String() string {
 
 type Database struct {
 	db *C.notmuch_database_t
+
+	// libnotmuch handles are not thread-safe. Callers sharing a Database
+	// between goroutines must hold the lock while using it.
+	sync.Mutex
 }
 
 type Query struct {
@@ -823,6 +829,22 @@ func (self *Message) GetReplies() *Messages {
 	return &Messages{messages: msgs}
 }
 
+/* Get all filenames for the email corresponding to 'message'.
+ *
+ * Returns a notmuch_filenames_t iterator listing all the filenames
+ * associated with 'message'. These files may not have identical
+ * content, but each will have the identical Message-ID.
+ *
+ * Each filename in the iterator is an absolute filename, (the initial
+ * component will match notmuch_database_get_path() ).
+ */
+func (self *Message) GetFileNames() *Filenames {
+	if self.message == nil {
+		return &Filenames{}
+	}
+	return &Filenames{fnames: C.notmuch_message_get_filenames(self.message)}
+}
+
 /* Get a filename for the email corresponding to 'message'.
  *
  * The returned filename is an absolute filename, (the initial
@@ -1035,6 +1057,66 @@ func (self *Message) RemoveAllTags() Status {
 	return Status(C.notmuch_message_remove_all_tags(self.message))
 }
 
+/* Add/remove tags according to maildir flags in the message filename(s).
+ *
+ * This function examines the filenames of 'message' for maildir
+ * flags, and adds or removes tags on 'message' as follows when these
+ * flags are present:
+ *
+ *	Flag	Action if present
+ *	----	-----------------
+ *	'D'	Adds the "draft" tag to the message
+ *	'F'	Adds the "flagged" tag to the message
+ *	'P'	Adds the "passed" tag to the message
+ *	'R'	Adds the "replied" tag to the message
+ *	'S'	Removes the "unread" tag from the message
+ *
+ * For each flag that is not present, the opposite action (add/remove)
+ * is performed for the corresponding tags.
+ *
+ * Flags are identified as trailing characters following the string
+ * ":2," in the filename.
+ */
+func (self *Message) MaildirFlagsToTags() Status {
+	if self.message == nil {
+		return STATUS_NULL_POINTER
+	}
+	return Status(C.notmuch_message_maildir_flags_to_tags(self.message))
+}
+
+/* Rename message filename(s) to encode tags as maildir flags.
+ *
+ * Specifically, for each filename corresponding to this message:
+ *
+ * If the filename is not in a maildir directory, do nothing.  (A
+ * maildir directory is determined as a directory named "new" or
+ * "cur".) Similarly, if the filename has invalid maildir info,
+ * (repeated or outof-ASCII-order flag characters after ":2,"), then
+ * do nothing.
+ *
+ * If the filename is in a maildir directory, rename the file so that
+ * its filename ends with the sequence ":2," followed by zero or more
+ * of the following single-character flags (in ASCII order):
+ *
+ *   'D' iff the message has the "draft" tag
+ *   'F' iff the message has the "flagged" tag
+ *   'P' iff the message has the "passed" tag
+ *   'R' iff the message has the "replied" tag
+ *   'S' iff the message does not have the "unread" tag
+ *
+ * Any existing flags unmentioned in the list above will be preserved
+ * in the renaming.
+ *
+ * Also, if this filename is in a directory named "new", rename it to
+ * be within the neighboring directory named "cur".
+ */
+func (self *Message) TagsToMaildirFlags() Status {
+	if self.message == nil {
+		return STATUS_NULL_POINTER
+	}
+	return Status(C.notmuch_message_tags_to_maildir_flags(self.message))
+}
+
 /* Freeze the current state of 'message' within the database.
  *
  * This means that changes to the message state, (via
@@ -1196,7 +1278,95 @@ func (self *Tags) Destroy() {
 	C.notmuch_tags_destroy(self.tags)
 }
 
-// TODO: wrap notmuch_directory_<fct>
+/* Store an mtime within the database for 'directory'.
+ *
+ * The 'directory' should be an object retrieved from the database
+ * with notmuch_database_get_directory for a particular path.
+ *
+ * The intention is for the caller to use the mtime to allow efficient
+ * identification of new messages to be added to the database. The
+ * recommended usage is as follows:
+ *
+ *   o Read the mtime of a directory from the filesystem
+ *
+ *   o Call add_message for all mail files in the directory
+ *
+ *   o Call notmuch_directory_set_mtime with the mtime read from the
+ *     filesystem.
+ *
+ * Then, when wanting to check for updates to the directory in the
+ * future, the client can call notmuch_directory_get_mtime and know
+ * that it only needs to add files if the mtime of the directory and
+ * files are newer than the stored timestamp.
+ *
+ * Return value:
+ *
+ * NOTMUCH_STATUS_SUCCESS: mtime successfully stored in database.
+ *
+ * NOTMUCH_STATUS_XAPIAN_EXCEPTION: A Xapian exception
+ *	occurred, mtime not stored.
+ *
+ * NOTMUCH_STATUS_READ_ONLY_DATABASE: Database was opened in read-only
+ *	mode so directory mtime cannot be modified.
+ */
+func (self *Directory) SetMtime(mtime time.Time) Status {
+	if self.dir == nil {
+		return STATUS_NULL_POINTER
+	}
+	return Status(C.notmuch_directory_set_mtime(self.dir, C.time_t(mtime.Unix())))
+}
+
+/* Get the mtime of a directory, (as previously stored with
+ * notmuch_directory_set_mtime).
+ *
+ * Returns 0 if no mtime has previously been stored for this
+ * directory.
+ */
+func (self *Directory) GetMtime() time.Time {
+	if self.dir == nil {
+		return time.Unix(0, 0)
+	}
+	return time.Unix(int64(C.notmuch_directory_get_mtime(self.dir)), 0)
+}
+
+/* Get a notmuch_filenames_t iterator listing all the filenames of
+ * messages in the database within the given directory.
+ *
+ * The returned filenames will be the basename-entries only (not
+ * complete paths).
+ */
+func (self *Directory) GetChildFiles() *Filenames {
+	if self.dir == nil {
+		return &Filenames{}
+	}
+	return &Filenames{fnames: C.notmuch_directory_get_child_files(self.dir)}
+}
+
+/* Get a notmuch_filenames_t iterator listing all the filenames of
+ * sub-directories in the database within the given directory.
+ *
+ * The returned filenames will be the basename-entries only (not
+ * complete paths).
+ */
+func (self *Directory) GetChildDirectories() *Filenames {
+	if self.dir == nil {
+		return &Filenames{}
+	}
+	return &Filenames{fnames: C.notmuch_directory_get_child_directories(self.dir)}
+}
+
+/* Delete directory document from the database, and destroy the
+ * notmuch_directory_t object. Assumes any child directories and files
+ * have been deleted by the caller.
+ */
+func (self *Directory) Delete() Status {
+	if self.dir == nil {
+		return STATUS_NULL_POINTER
+	}
+	st := Status(C.notmuch_directory_delete(self.dir))
+	self.dir = nil
+	return st
+}
 
 /* Destroy a notmuch_directory_t object. */
 func (self *Directory) Destroy() {
@@ -1206,7 +1376,44 @@ func (self *Directory) Destroy() {
 	C.notmuch_directory_destroy(self.dir)
 }
 
-// TODO: wrap notmuch_filenames_<fct>
+/* Is the given 'filenames' iterator pointing at a valid filename.
+ *
+ * When this function returns TRUE, notmuch_filenames_get will return
+ * a valid string. Whereas when this function returns FALSE,
+ * notmuch_filenames_get will return NULL.
+ */
+func (self *Filenames) Valid() bool {
+	if self.fnames == nil {
+		return false
+	}
+	return C.notmuch_filenames_valid(self.fnames) != 0
+}
+
+/* Get the current filename from 'filenames' as a string.
+ *
+ * Note: The returned string belongs to 'filenames' and has a lifetime
+ * identical to it (and the directory to which it ultimately belongs).
+ */
+func (self *Filenames) Get() string {
+	if self.fnames == nil {
+		return ""
+	}
+	return C.GoString(C.notmuch_filenames_get(self.fnames))
+}
+
+/* Move the 'filenames' iterator to the next filename.
+ *
+ * If 'filenames' is already pointing at the last filename then the
+ * iterator will be moved to a point just beyond that last filename,
+ * (where notmuch_filenames_valid will return FALSE and
+ * notmuch_filenames_get will return NULL).
+ */
+func (self *Filenames) MoveToNext() {
+	if self.fnames == nil {
+		return
+	}
+	C.notmuch_filenames_move_to_next(self.fnames)
+}
 
 /* Destroy a notmuch_filenames_t object.
  *
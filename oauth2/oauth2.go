@@ -0,0 +1,215 @@
+// Package oauth2 implements the OAuth2 refresh token flow, and the SASL mechanisms
+// (XOAUTH2 and OAUTHBEARER) used to authenticate with an OAuth2 access token
+package oauth2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yzzyx/mr/source"
+)
+
+// Token endpoints of well-known providers
+var providerTokenURLs = map[string]string{
+	"google":    "https://oauth2.googleapis.com/token",
+	"microsoft": "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+}
+
+// Access tokens are refreshed a while before they expire, so that they don't expire while in use
+const expiryMargin = 1 * time.Minute
+
+// Config defines how OAuth2 access tokens are retrieved
+type Config struct {
+	// Either "google" or "microsoft", used to set the default token URL
+	Provider string
+	TokenURL string `yaml:"token_url"`
+
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+	Scope        string
+
+	// Command which prints an access token on stdout, used instead of the refresh token flow
+	TokenCommand string `yaml:"token_command"`
+}
+
+// Token is an access token, as stored in the token cache
+type Token struct {
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// valid returns true if the token can still be used
+func (t *Token) valid() bool {
+	return t.AccessToken != "" && time.Now().Add(expiryMargin).Before(t.Expiry)
+}
+
+// TokenSource returns access tokens for a specific configuration, and caches them on disk
+type TokenSource struct {
+	cfg       Config
+	cachePath string
+
+	mu    sync.Mutex
+	token Token
+}
+
+// NewTokenSource creates a new TokenSource.
+// Access tokens are cached in cachePath, which is created with 0600 permissions
+func NewTokenSource(cfg Config, cachePath string) *TokenSource {
+	return &TokenSource{cfg: cfg, cachePath: cachePath}
+}
+
+// Token returns a valid access token, refreshing it if necessary
+func (ts *TokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	// The token command is responsible for its own caching
+	if ts.cfg.TokenCommand != "" {
+		return runTokenCommand(ts.cfg.TokenCommand)
+	}
+
+	if ts.token.valid() {
+		return ts.token.AccessToken, nil
+	}
+
+	// Check if another process has refreshed the token
+	data, err := ioutil.ReadFile(ts.cachePath)
+	if err == nil {
+		var cached Token
+		if json.Unmarshal(data, &cached) == nil && cached.valid() {
+			ts.token = cached
+			return ts.token.AccessToken, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	token, err := ts.refresh()
+	if err != nil {
+		return "", err
+	}
+	ts.token = token
+
+	err = writeCache(ts.cachePath, token)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// refresh requests a new access token from the token endpoint, using the refresh token
+func (ts *TokenSource) refresh() (Token, error) {
+	tokenURL := ts.cfg.TokenURL
+	if tokenURL == "" {
+		tokenURL = providerTokenURLs[ts.cfg.Provider]
+	}
+	if tokenURL == "" {
+		return Token{}, errors.New("oauth2 token url not configured")
+	}
+	if ts.cfg.ClientID == "" {
+		return Token{}, errors.New("oauth2 client id not configured")
+	}
+	if ts.cfg.RefreshToken == "" {
+		return Token{}, errors.New("oauth2 refresh token not configured")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("client_id", ts.cfg.ClientID)
+	form.Set("refresh_token", ts.cfg.RefreshToken)
+	if ts.cfg.ClientSecret != "" {
+		form.Set("client_secret", ts.cfg.ClientSecret)
+	}
+	if ts.cfg.Scope != "" {
+		form.Set("scope", ts.cfg.Scope)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(tokenURL, form)
+	if err != nil {
+		return Token{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Token{}, err
+	}
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return Token{}, fmt.Errorf("cannot parse oauth2 token response (%s): %s", resp.Status, err)
+	}
+	if result.Error != "" {
+		return Token{}, fmt.Errorf("cannot refresh oauth2 token: %s %s", result.Error, result.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return Token{}, fmt.Errorf("cannot refresh oauth2 token: %s", resp.Status)
+	}
+
+	// Tokens without expiry information are assumed to be valid for an hour
+	expiresIn := time.Duration(result.ExpiresIn) * time.Second
+	if expiresIn == 0 {
+		expiresIn = time.Hour
+	}
+
+	return Token{
+		AccessToken: result.AccessToken,
+		Expiry:      time.Now().Add(expiresIn),
+	}, nil
+}
+
+// writeCache stores a token in the cache file, which is only readable by the current user
+func writeCache(path string, token Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	// WriteFile doesn't change the permissions of existing files
+	err = os.Chmod(tmpPath, 0600)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// runTokenCommand runs a shell command, and returns the first line of its output
+func runTokenCommand(command string) (string, error) {
+	token, err := source.PasswordCommand(command)
+	if err != nil {
+		return "", err
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", errors.New("token command returned an empty token")
+	}
+	return token, nil
+}
@@ -0,0 +1,258 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenServer is an OAuth2 token endpoint, which hands out numbered access tokens
+type tokenServer struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	form     map[string]string
+	response string // Response sent instead of a new token, if set
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	ts := &tokenServer{}
+	ts.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		ts.requests++
+
+		err := r.ParseForm()
+		if err != nil {
+			t.Error(err)
+		}
+		ts.form = make(map[string]string)
+		for key := range r.PostForm {
+			ts.form[key] = r.PostForm.Get(key)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if ts.response != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, ts.response)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token%d", "token_type": "Bearer", "expires_in": 3600}`, ts.requests)
+	}))
+	return ts
+}
+
+func (ts *tokenServer) Close() {
+	ts.server.Close()
+}
+
+func (ts *tokenServer) config() Config {
+	return Config{
+		TokenURL:     ts.server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RefreshToken: "refresh",
+	}
+}
+
+// tempDir creates a temporary directory, and returns a function which removes it
+func tempDir(t *testing.T) (string, func()) {
+	path, err := ioutil.TempDir("", "mr-oauth2-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { _ = os.RemoveAll(path) }
+}
+
+// writeToken writes a token to a cache file, as another process would
+func writeToken(t *testing.T, path string, token Token, perm os.FileMode) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, data, perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		cached   *Token // Contents of the cache file before the token is requested
+		perm     os.FileMode
+		expected string
+		requests int
+	}{
+		{name: "no cache", expected: "token1", requests: 1},
+		{name: "valid cache", cached: &Token{AccessToken: "cached", Expiry: time.Now().Add(time.Hour)}, perm: 0600, expected: "cached"},
+		{name: "expired cache", cached: &Token{AccessToken: "cached", Expiry: time.Now().Add(-time.Hour)}, perm: 0600, expected: "token1", requests: 1},
+		// Tokens that are about to expire are refreshed
+		{name: "expiring cache", cached: &Token{AccessToken: "cached", Expiry: time.Now().Add(expiryMargin / 2)}, perm: 0600, expected: "token1", requests: 1},
+		// The permissions of an existing cache file are fixed when it's written
+		{name: "readable cache", cached: &Token{AccessToken: "cached", Expiry: time.Now().Add(-time.Hour)}, perm: 0644, expected: "token1", requests: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTokenServer(t)
+			defer server.Close()
+			path, cleanup := tempDir(t)
+			defer cleanup()
+
+			cachePath := filepath.Join(path, "cache", "token")
+			if test.cached != nil {
+				err := os.MkdirAll(filepath.Dir(cachePath), 0700)
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeToken(t, cachePath, *test.cached, test.perm)
+			}
+
+			ts := NewTokenSource(server.config(), cachePath)
+			token, err := ts.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != test.expected {
+				t.Errorf("expected token %s, got %s", test.expected, token)
+			}
+
+			// The token is kept until it expires
+			token, err = ts.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != test.expected || server.requests != test.requests {
+				t.Errorf("expected token %s after %d request(s), got %s after %d", test.expected, test.requests, token, server.requests)
+			}
+			if test.requests == 0 {
+				return
+			}
+
+			form := server.form
+			if form["grant_type"] != "refresh_token" || form["refresh_token"] != "refresh" ||
+				form["client_id"] != "client" || form["client_secret"] != "secret" {
+				t.Errorf("unexpected token request %v", form)
+			}
+
+			info, err := os.Stat(cachePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := info.Mode().Perm(); perm != 0600 {
+				t.Errorf("expected cache permissions 0600, got %o", perm)
+			}
+
+			// Other token sources use the cached token
+			token, err = NewTokenSource(server.config(), cachePath).Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != test.expected || server.requests != test.requests {
+				t.Errorf("expected cached token %s, got %s after %d request(s)", test.expected, token, server.requests)
+			}
+		})
+	}
+}
+
+func TestTokenErrors(t *testing.T) {
+	server := newTokenServer(t)
+	defer server.Close()
+	path, cleanup := tempDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		response string
+	}{
+		{name: "no token url", cfg: Config{ClientID: "client", RefreshToken: "refresh"}},
+		{name: "no client id", cfg: Config{TokenURL: server.server.URL, RefreshToken: "refresh"}},
+		{name: "no refresh token", cfg: Config{TokenURL: server.server.URL, ClientID: "client"}},
+		{name: "invalid grant", cfg: server.config(), response: `{"error": "invalid_grant", "error_description": "expired"}`},
+		{name: "invalid response", cfg: server.config(), response: `<html>`},
+		{name: "failing command", cfg: Config{TokenCommand: "exit 1"}},
+		{name: "empty command output", cfg: Config{TokenCommand: "echo"}},
+	}
+
+	for _, test := range tests {
+		server.mu.Lock()
+		server.response = test.response
+		server.mu.Unlock()
+		ts := NewTokenSource(test.cfg, filepath.Join(path, "token"))
+		token, err := ts.Token()
+		if err == nil {
+			t.Errorf("%s: expected error, got token %s", test.name, token)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(path, "token")); !os.IsNotExist(err) {
+		t.Errorf("expected no cache file after failures, got %v", err)
+	}
+}
+
+func TestTokenCommand(t *testing.T) {
+	ts := NewTokenSource(Config{TokenCommand: "printf ' command-token \\nsecond line\\n'"}, "")
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "command-token" {
+		t.Errorf("expected token from command, got %q", token)
+	}
+}
+
+func TestSASL(t *testing.T) {
+	tests := []struct {
+		client interface {
+			Start() (string, []byte, error)
+			Next([]byte) ([]byte, error)
+		}
+		mech string
+		ir   string
+	}{
+		{
+			client: &XOAuth2Client{Username: "user@example.org", Token: "token"},
+			mech:   "XOAUTH2",
+			ir:     "user=user@example.org\x01auth=Bearer token\x01\x01",
+		},
+		{
+			client: &OAuthBearerClient{Username: "user@example.org", Token: "token"},
+			mech:   "OAUTHBEARER",
+			ir:     "n,a=user@example.org,\x01auth=Bearer token\x01\x01",
+		},
+		{
+			client: &OAuthBearerClient{Username: "user@example.org", Token: "token", Host: "imap.example.org", Port: 993},
+			mech:   "OAUTHBEARER",
+			ir:     "n,a=user@example.org,\x01host=imap.example.org\x01port=993\x01auth=Bearer token\x01\x01",
+		},
+	}
+
+	for _, test := range tests {
+		mech, ir, err := test.client.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mech != test.mech || string(ir) != test.ir {
+			t.Errorf("expected %s %q, got %s %q", test.mech, test.ir, mech, ir)
+		}
+
+		// A challenge is only sent when authentication fails
+		_, err = test.client.Next([]byte(`{"status":"invalid_token","schemes":"Bearer","scope":"mail"}`))
+		if err == nil || err.Error() != "oauth2 authentication failed: status invalid_token" {
+			t.Errorf("%s: unexpected error %v", mech, err)
+		}
+		_, err = test.client.Next([]byte("garbage"))
+		if err == nil || err.Error() != "oauth2 authentication failed" {
+			t.Errorf("%s: unexpected error %v", mech, err)
+		}
+	}
+}
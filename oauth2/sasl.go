@@ -0,0 +1,67 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The SASL clients below implement the Client interface of github.com/emersion/go-sasl
+
+// authError describes the JSON error sent by the server when authentication fails
+type authError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope"`
+}
+
+func parseAuthError(challenge []byte) error {
+	var e authError
+	if err := json.Unmarshal(challenge, &e); err != nil || e.Status == "" {
+		return errors.New("oauth2 authentication failed")
+	}
+	return fmt.Errorf("oauth2 authentication failed: status %s", e.Status)
+}
+
+// XOAuth2Client implements the XOAUTH2 mechanism, as used by Google and Microsoft
+type XOAuth2Client struct {
+	Username string
+	Token    string
+}
+
+// Start begins the authentication
+func (c *XOAuth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + c.Username + "\x01auth=Bearer " + c.Token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+// Next handles a challenge from the server, which is only sent if authentication failed
+func (c *XOAuth2Client) Next(challenge []byte) ([]byte, error) {
+	return nil, parseAuthError(challenge)
+}
+
+// OAuthBearerClient implements the OAUTHBEARER mechanism, as defined in RFC 7628
+type OAuthBearerClient struct {
+	Username string
+	Token    string
+	Host     string
+	Port     int
+}
+
+// Start begins the authentication
+func (c *OAuthBearerClient) Start() (mech string, ir []byte, err error) {
+	msg := "n,a=" + c.Username + ","
+	if c.Host != "" {
+		msg += "\x01host=" + c.Host
+	}
+	if c.Port != 0 {
+		msg += fmt.Sprintf("\x01port=%d", c.Port)
+	}
+	msg += "\x01auth=Bearer " + c.Token + "\x01\x01"
+	return "OAUTHBEARER", []byte(msg), nil
+}
+
+// Next handles a challenge from the server, which is only sent if authentication failed
+func (c *OAuthBearerClient) Next(challenge []byte) ([]byte, error) {
+	return nil, parseAuthError(challenge)
+}
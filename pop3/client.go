@@ -0,0 +1,150 @@
+package pop3
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yzzyx/mr/source"
+)
+
+// client is a minimal POP3 client, as defined in RFC 1939
+type client struct {
+	conn *source.TimeoutConn
+	text *textproto.Conn
+}
+
+// dial connects to a POP3 server, and reads its greeting.
+// If tlsConfig is set, TLS is used from the start.
+func dial(addr string, tlsConfig *tls.Config, connectTimeout, timeout time.Duration) (*client, error) {
+	conn, err := net.DialTimeout("tcp", addr, connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	c := newClient(source.NewTimeoutConn(conn, timeout))
+	_, err = c.response()
+	if err != nil {
+		_ = c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(conn *source.TimeoutConn) *client {
+	return &client{conn: conn, text: textproto.NewConn(conn)}
+}
+
+// response reads a status line, and returns the text following +OK
+func (c *client) response() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(line[len("+OK"):]), nil
+	}
+	if strings.HasPrefix(line, "-ERR") {
+		return "", fmt.Errorf("pop3 server error: %s", strings.TrimSpace(line[len("-ERR"):]))
+	}
+	return "", fmt.Errorf("invalid pop3 response: %s", line)
+}
+
+// cmd sends a command, and returns the text of the response
+func (c *client) cmd(format string, args ...interface{}) (string, error) {
+	err := c.text.PrintfLine(format, args...)
+	if err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+// startTLS upgrades the connection to TLS with the STLS command (RFC 2595)
+func (c *client) startTLS(tlsConfig *tls.Config) error {
+	_, err := c.cmd("STLS")
+	if err != nil {
+		return err
+	}
+
+	// The timeout still applies to the connection underneath TLS
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	c.text = textproto.NewConn(tlsConn)
+	return nil
+}
+
+// login authenticates with USER and PASS
+func (c *client) login(username, password string) error {
+	_, err := c.cmd("USER %s", username)
+	if err != nil {
+		return err
+	}
+	_, err = c.cmd("PASS %s", password)
+	return err
+}
+
+// uidl returns the unique id of each message, by message number
+func (c *client) uidl() (map[int]string, error) {
+	_, err := c.cmd("UIDL")
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make(map[int]string, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid UIDL response: %s", line)
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid UIDL response: %s", line)
+		}
+		uids[n] = fields[1]
+	}
+	return uids, nil
+}
+
+// retr downloads a message. Lines end with "\n" instead of "\r\n" in the returned message.
+func (c *client) retr(n int) ([]byte, error) {
+	_, err := c.cmd("RETR %d", n)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(c.text.DotReader())
+}
+
+// dele marks a message as deleted. It's removed when the session ends with quit.
+func (c *client) dele(n int) error {
+	_, err := c.cmd("DELE %d", n)
+	return err
+}
+
+// quit ends the session, which removes deleted messages, and closes the connection
+func (c *client) quit() error {
+	_, err := c.cmd("QUIT")
+	if closeErr := c.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *client) close() error {
+	return c.text.Close()
+}
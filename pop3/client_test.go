@@ -0,0 +1,173 @@
+package pop3
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is a POP3 server which serves a fixed list of messages
+type fakeServer struct {
+	listener net.Listener
+	messages []string
+	uids     []string
+
+	// Message numbers marked with DELE, sent when the session ends
+	deleted chan []int
+}
+
+func newFakeServer(t *testing.T, uids []string, messages []string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{listener: l, uids: uids, messages: messages, deleted: make(chan []int, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			_, _ = w.WriteString(line + "\r\n")
+		}
+		_ = w.Flush()
+	}
+
+	var deleted []int
+	reply("+OK ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch strings.ToUpper(fields[0]) {
+		case "USER":
+			reply("+OK")
+		case "PASS":
+			if fields[1] != "password" {
+				reply("-ERR invalid password")
+				continue
+			}
+			reply("+OK logged in")
+		case "UIDL":
+			reply("+OK")
+			for i, uid := range s.uids {
+				reply(strconv.Itoa(i+1) + " " + uid)
+			}
+			reply(".")
+		case "RETR":
+			n, _ := strconv.Atoi(fields[1])
+			reply("+OK")
+			for _, l := range strings.Split(s.messages[n-1], "\n") {
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				reply(l)
+			}
+			reply(".")
+		case "DELE":
+			n, _ := strconv.Atoi(fields[1])
+			deleted = append(deleted, n)
+			reply("+OK")
+		case "QUIT":
+			reply("+OK bye")
+			s.deleted <- deleted
+			return
+		default:
+			reply("-ERR unknown command")
+		}
+	}
+}
+
+func (s *fakeServer) Close() {
+	_ = s.listener.Close()
+}
+
+func TestClient(t *testing.T) {
+	messages := []string{
+		"Message-ID: <1@example.org>\n\nfirst",
+		"Message-ID: <2@example.org>\n\n.starts with a dot\n..two dots",
+	}
+	s := newFakeServer(t, []string{"uid-a", "uid-b"}, messages)
+	defer s.Close()
+
+	c, err := dial(s.listener.Addr().String(), nil, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.login("username", "wrong")
+	if err == nil || !strings.Contains(err.Error(), "invalid password") {
+		t.Errorf("expected login to fail, got %v", err)
+	}
+	err = c.login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uids, err := c.uidl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]string{1: "uid-a", 2: "uid-b"}
+	if !reflect.DeepEqual(uids, expected) {
+		t.Errorf("expected uids %v, got %v", expected, uids)
+	}
+
+	data, err := c.retr(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != messages[1]+"\n" {
+		t.Errorf("expected message %q, got %q", messages[1]+"\n", data)
+	}
+
+	err = c.dele(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.quit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := <-s.deleted
+	if !reflect.DeepEqual(deleted, []int{1}) {
+		t.Errorf("expected message 1 to be deleted, got %v", deleted)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	// A server which accepts connections, but never sends a greeting
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	_, err = dial(l.Addr().String(), nil, time.Second, 100*time.Millisecond)
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+// Package pop3 downloads messages from POP3 servers into the local maildir
+package pop3
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/yzzyx/mr/config"
+	"github.com/yzzyx/mr/notmuch"
+	"github.com/yzzyx/mr/source"
+)
+
+// POP3 servers only have a single folder, which is stored like the INBOX of an IMAP account
+const inboxFolder = "INBOX"
+
+// The synchronization state is saved after this many messages have been downloaded
+const checkpointInterval = 20
+
+// Account defines the available options for a POP3 account
+type Account struct {
+	Server      string
+	Port        int
+	Username    string
+	Password    string
+	UseTLS      bool `yaml:"use_tls"`
+	UseStartTLS bool `yaml:"use_starttls"`
+
+	// A command which prints the password, instead of storing it in the configuration file
+	PasswordCommand string `yaml:"password_command"`
+
+	// Timeouts in seconds: for opening a connection, and for waiting on the server
+	ConnectTimeout int `yaml:"connect_timeout"`
+	Timeout        int
+
+	// Leave downloaded messages on the server. If KeepDays is set, they're removed
+	// from the server that many days after they were downloaded.
+	LeaveOnServer bool `yaml:"leave_on_server"`
+	KeepDays      int  `yaml:"keep_days"`
+}
+
+// Handler downloads messages from a single POP3 account
+type Handler struct {
+	db          *notmuch.Database
+	maildirPath string
+	account     Account
+
+	state    state
+	lockFile *os.File
+
+	// Progress information is written to out
+	out io.Writer
+
+	// Connection used by the current synchronization pass, and the UIDL listing of the server
+	c    *client
+	uids map[int]string
+}
+
+func init() {
+	source.Register("pop3", newSource)
+}
+
+// newSource creates a handler from the configuration of an account
+func newSource(db *notmuch.Database, path string, account *config.Account) (source.MailSource, error) {
+	var a Account
+	err := account.Decode(&a)
+	if err != nil {
+		return nil, err
+	}
+	return New(db, path, a)
+}
+
+// New creates a new Handler
+func New(db *notmuch.Database, maildirPath string, account Account) (*Handler, error) {
+	var err error
+	h := &Handler{
+		db:          db,
+		maildirPath: maildirPath,
+		account:     account,
+		out:         os.Stdout,
+	}
+
+	err = os.MkdirAll(maildirPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	h.lockFile, err = source.LockFile(filepath.Join(maildirPath, lockFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.loadState()
+	if err != nil {
+		source.UnlockFile(h.lockFile)
+		return nil, err
+	}
+	return h, nil
+}
+
+// SetOutput sets the destination of progress information (defaults to os.Stdout)
+func (h *Handler) SetOutput(w io.Writer) {
+	h.out = w
+}
+
+// Close saves the synchronization state
+func (h *Handler) Close() error {
+	defer source.UnlockFile(h.lockFile)
+	return h.saveState()
+}
+
+// Connect opens a connection to the server, and logs in
+func (h *Handler) Connect() error {
+	if h.account.Server == "" {
+		return errors.New("pop3 server address not configured")
+	}
+	if h.account.Username == "" {
+		return errors.New("pop3 username not configured")
+	}
+	password, err := h.password()
+	if err != nil {
+		return err
+	}
+
+	port := h.account.Port
+	if port == 0 {
+		port = 110
+		if h.account.UseTLS {
+			port = 995
+		}
+	}
+
+	connectTimeout := source.DefaultConnectTimeout
+	if h.account.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(h.account.ConnectTimeout) * time.Second
+	}
+	timeout := source.DefaultTimeout
+	if h.account.Timeout > 0 {
+		timeout = time.Duration(h.account.Timeout) * time.Second
+	}
+
+	tlsConfig := &tls.Config{ServerName: h.account.Server}
+	addr := fmt.Sprintf("%s:%d", h.account.Server, port)
+	var c *client
+	if h.account.UseTLS {
+		c, err = dial(addr, tlsConfig, connectTimeout, timeout)
+	} else {
+		c, err = dial(addr, nil, connectTimeout, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if h.account.UseStartTLS {
+		err = c.startTLS(tlsConfig)
+		if err != nil {
+			_ = c.close()
+			return err
+		}
+	}
+
+	err = c.login(h.account.Username, password)
+	if err != nil {
+		_ = c.close()
+		return err
+	}
+	h.c = c
+	return nil
+}
+
+// Disconnect ends the session, which removes the messages marked for deletion by PushChanges
+func (h *Handler) Disconnect() {
+	if h.c == nil {
+		return
+	}
+	err := h.c.quit()
+	if err != nil {
+		fmt.Fprintf(h.out, "could not end pop3 session: %s\n", err)
+	}
+	h.c = nil
+	h.uids = nil
+}
+
+// password returns the configured password, or the output of PasswordCommand
+func (h *Handler) password() (string, error) {
+	if h.account.Password != "" {
+		return h.account.Password, nil
+	}
+	if h.account.PasswordCommand == "" {
+		return "", errors.New("pop3 password not configured")
+	}
+
+	password, err := source.PasswordCommand(h.account.PasswordCommand)
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("pop3 password is empty")
+	}
+	return password, nil
+}
+
+// ListFolders returns the only folder of a POP3 account
+func (h *Handler) ListFolders() ([]string, error) {
+	return []string{inboxFolder}, nil
+}
+
+// FetchNew downloads the messages which haven't been seen before, based on their unique id (UIDL)
+func (h *Handler) FetchNew(folder string) error {
+	uids, err := h.c.uidl()
+	if err != nil {
+		return err
+	}
+	h.uids = uids
+
+	// Forget messages which have been removed from the server
+	onServer := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		onServer[uid] = true
+	}
+	for uid := range h.state.Messages {
+		if !onServer[uid] {
+			delete(h.state.Messages, uid)
+		}
+	}
+
+	var numbers []int
+	for n, uid := range uids {
+		if _, ok := h.state.Messages[uid]; !ok {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+
+	for i, n := range numbers {
+		data, err := h.c.retr(n)
+		if err != nil {
+			return err
+		}
+
+		messageID, err := h.storeMessage(folder, data)
+		if err != nil {
+			return err
+		}
+		h.state.Messages[uids[n]] = &messageState{MessageID: messageID, Downloaded: time.Now()}
+
+		if (i+1)%checkpointInterval == 0 {
+			h.checkpoint()
+		}
+	}
+	h.checkpoint()
+	return nil
+}
+
+// PushChanges marks messages which have been downloaded for deletion on the server,
+// unless they should be left on the server
+func (h *Handler) PushChanges(folder string) error {
+	if h.account.LeaveOnServer && h.account.KeepDays <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -h.account.KeepDays)
+	for n, uid := range h.uids {
+		msg, ok := h.state.Messages[uid]
+		if !ok {
+			continue
+		}
+		if h.account.LeaveOnServer && msg.Downloaded.After(cutoff) {
+			continue
+		}
+
+		err := h.c.dele(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeMessage stores a message in the maildir of a folder, and adds it to the index with the
+// "inbox" and "unread" tags. The message id of the message is returned.
+func (h *Handler) storeMessage(folder string, data []byte) (string, error) {
+	newPath, err := source.StoreMaildirMessage(filepath.Join(h.maildirPath, folder), bytes.NewReader(data), "", ":2,")
+	if err != nil {
+		return "", err
+	}
+
+	// Add file to index
+	h.db.Lock()
+	defer h.db.Unlock()
+	m, st := h.db.AddMessage(newPath)
+	if m == nil {
+		return "", errors.New(st.String())
+	}
+	defer m.Destroy()
+
+	messageID := m.GetMessageId()
+	if st == notmuch.STATUS_DUPLICATE_MESSAGE_ID {
+		// We've already seen this one
+		return messageID, nil
+	}
+	if st != notmuch.STATUS_SUCCESS {
+		return "", errors.New(st.String())
+	}
+
+	m.AddTag("unread")
+	m.AddTag("inbox")
+	fmt.Fprintf(h.out, " tagging %s: inbox,unread\n", filepath.Base(newPath))
+	return messageID, nil
+}
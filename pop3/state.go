@@ -0,0 +1,62 @@
+package pop3
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/yzzyx/mr/source"
+)
+
+// Version of the format of the state file
+const stateVersion = 1
+
+// Files in the maildir of a handler
+const (
+	stateFilename = ".pop3-uids"
+	lockFilename  = ".pop3-uids.lock"
+)
+
+type state struct {
+	// Version of the state format, see stateVersion
+	Version int
+
+	// Messages which have been downloaded, by unique id
+	Messages map[string]*messageState
+}
+
+// messageState describes a message which has been downloaded from the server
+type messageState struct {
+	MessageID  string
+	Downloaded time.Time
+}
+
+// loadState reads the synchronization state of the handler
+func (h *Handler) loadState() error {
+	h.state.Version = stateVersion
+	h.state.Messages = make(map[string]*messageState)
+
+	path := filepath.Join(h.maildirPath, stateFilename)
+	_, err := source.LoadState(path, &h.state)
+	if err != nil {
+		return err
+	}
+	err = source.CheckStateVersion(path, h.state.Version, stateVersion)
+	if err != nil {
+		return err
+	}
+	if h.state.Messages == nil {
+		h.state.Messages = make(map[string]*messageState)
+	}
+	return nil
+}
+
+// saveState writes the synchronization state of the handler
+func (h *Handler) saveState() error {
+	return source.SaveState(filepath.Join(h.maildirPath, stateFilename), h.state)
+}
+
+// checkpoint saves the synchronization state while downloading, so that messages aren't
+// downloaded again if we crash
+func (h *Handler) checkpoint() {
+	source.Checkpoint(h.out, h.saveState)
+}
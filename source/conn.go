@@ -0,0 +1,76 @@
+package source
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Default timeouts for connections to servers, used if they're not set in the configuration
+const (
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultTimeout        = 5 * time.Minute
+)
+
+// TimeoutConn is a connection which fails if the server doesn't send anything for a while.
+// The timeout starts over whenever data is received, so long downloads don't fail as long
+// as the server keeps sending.
+type TimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu     sync.Mutex
+	paused bool
+}
+
+// NewTimeoutConn wraps a connection in a TimeoutConn
+func NewTimeoutConn(conn net.Conn, timeout time.Duration) *TimeoutConn {
+	return &TimeoutConn{Conn: conn, timeout: timeout}
+}
+
+// armReadDeadline makes pending and future reads fail if nothing is received within the timeout
+func (c *TimeoutConn) armReadDeadline() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+}
+
+func (c *TimeoutConn) Read(b []byte) (int, error) {
+	err := c.armReadDeadline()
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *TimeoutConn) Write(b []byte) (int, error) {
+	err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// SetDeadline ignores the deadline, and starts the timeout over instead
+func (c *TimeoutConn) SetDeadline(t time.Time) error {
+	return c.armReadDeadline()
+}
+
+// Pause disables the timeout, e.g. while waiting for updates from the server
+func (c *TimeoutConn) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+	_ = c.Conn.SetReadDeadline(time.Time{})
+}
+
+// Resume enables the timeout again after Pause
+func (c *TimeoutConn) Resume() {
+	c.mu.Lock()
+	c.paused = false
+	c.mu.Unlock()
+	_ = c.armReadDeadline()
+}
@@ -0,0 +1,63 @@
+package source
+
+import (
+	"sort"
+
+	"github.com/yzzyx/mr/notmuch"
+)
+
+// MergeFlag performs a three-way merge of a single flag (or keyword, label or mailbox) of a message,
+// between the state on the server, the local state (as represented by tags) and the state when the
+// message was last synchronized. Since a flag can only be set or unset, the side that differs from
+// the last synchronized state wins. If the message hasn't been synchronized before, the server wins.
+func MergeFlag(remote, local, last, haveLast bool) bool {
+	if remote == local || !haveLast {
+		return remote
+	}
+	if remote != last {
+		return remote
+	}
+	return local
+}
+
+// StringSet returns a set containing the strings in list
+func StringSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, s := range list {
+		set[s] = true
+	}
+	return set
+}
+
+// MaildirInfo returns the maildir info suffix for a message with a set of flags, e.g. ":2,FS".
+// infoFlags maps the flags to maildir info flags, and other flags are ignored.
+func MaildirInfo(flags []string, infoFlags map[string]byte) string {
+	var info []byte
+	for _, flag := range flags {
+		if f, ok := infoFlags[flag]; ok {
+			info = append(info, f)
+		}
+	}
+
+	// Flags must be in ASCII order
+	sort.Slice(info, func(i, j int) bool { return info[i] < info[j] })
+	return ":2," + string(info)
+}
+
+// LocalTags returns the current tags of a message in the index, or false if the message is not indexed.
+// The database must be locked by the caller.
+func LocalTags(db *notmuch.Database, messageID string) (map[string]bool, bool) {
+	m, st := db.FindMessage(messageID)
+	if m == nil || st != notmuch.STATUS_SUCCESS {
+		return nil, false
+	}
+	defer m.Destroy()
+
+	tags := make(map[string]bool)
+	it := m.GetTags()
+	for it.Valid() {
+		tags[it.Get()] = true
+		it.MoveToNext()
+	}
+	return tags, true
+}
@@ -0,0 +1,57 @@
+package source
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Local maildir layouts
+const (
+	// Each level of the folder hierarchy is a directory, e.g. INBOX/Sub
+	LayoutNested = "nested"
+	// All folders are stored in the top directory, separated by dots, e.g. .INBOX.Sub
+	LayoutMaildirPlusPlus = "maildir++"
+)
+
+// CheckLayout returns an error if layout isn't one of the supported layouts.
+// An empty layout is the same as LayoutNested.
+func CheckLayout(layout string) error {
+	switch layout {
+	case "", LayoutNested, LayoutMaildirPlusPlus:
+		return nil
+	}
+	return fmt.Errorf("unknown folder layout %s", layout)
+}
+
+// EscapeFolderPart makes a single level of a folder name safe to use in a filename.
+// Names such as ".." are never used as they are, since folder names are chosen by the server.
+func EscapeFolderPart(part string, reserved string) string {
+	part = strings.Map(func(r rune) rune {
+		if r == filepath.Separator || r == '/' || strings.ContainsRune(reserved, r) {
+			return '_'
+		}
+		return r
+	}, part)
+	if part == "" || part == "." || part == ".." {
+		return strings.Repeat("_", len(part)+1)
+	}
+	return part
+}
+
+// LocalFolder returns the path of the maildir of a folder, relative to the maildir of the account.
+// parts are the names of the folder and its parents, starting at the top of the hierarchy.
+func LocalFolder(parts []string, layout string) string {
+	escaped := make([]string, len(parts))
+	if layout == LayoutMaildirPlusPlus {
+		for i := range parts {
+			escaped[i] = EscapeFolderPart(parts[i], ".")
+		}
+		return "." + strings.Join(escaped, ".")
+	}
+
+	for i := range parts {
+		escaped[i] = EscapeFolderPart(parts[i], "")
+	}
+	return filepath.Join(escaped...)
+}
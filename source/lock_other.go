@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package source
+
+import "os"
+
+// LockFile only creates the lock file, since flock isn't available on this platform
+func LockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+}
+
+// UnlockFile releases a lock taken by LockFile
+func UnlockFile(fd *os.File) {
+	_ = fd.Close()
+}
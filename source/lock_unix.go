@@ -0,0 +1,35 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package source
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile takes an exclusive lock on a file, which is created if it doesn't exist.
+// The lock is released when the process exits, or by UnlockFile.
+// ErrLocked is returned if another process holds the lock.
+func LockFile(path string) (*os.File, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = fd.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return fd, nil
+}
+
+// UnlockFile releases a lock taken by LockFile
+func UnlockFile(fd *os.File) {
+	_ = syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+	_ = fd.Close()
+}
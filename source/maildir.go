@@ -0,0 +1,77 @@
+package source
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Used to generate unique maildir filenames
+var (
+	seqNum       uint64
+	hostname     string
+	hostnameErr  error
+	hostnameOnce sync.Once
+)
+
+// uniqueFilename returns a new unique maildir filename, without any fields or info
+func uniqueFilename() (string, error) {
+	hostnameOnce.Do(func() {
+		hostname, hostnameErr = os.Hostname()
+	})
+	if hostnameErr != nil {
+		return "", hostnameErr
+	}
+	return fmt.Sprintf("%d_%d.%d.%s", time.Now().Unix(), atomic.AddUint64(&seqNum, 1), os.Getpid(), hostname), nil
+}
+
+// StoreMaildirMessage stores a message in a new file in the maildir at folderPath, which is
+// created if it doesn't exist. The message is written to tmp, and then moved to cur, with a
+// name consisting of a unique part, fields (e.g. ",U=12"), the MD5 checksum of the message
+// and info (e.g. ":2,S"). The path of the new file is returned.
+func StoreMaildirMessage(folderPath string, r io.Reader, fields string, info string) (string, error) {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(folderPath, dir), 0700)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	filename, err := uniqueFilename()
+	if err != nil {
+		return "", err
+	}
+	filename += fields
+	tmpPath := filepath.Join(folderPath, "tmp", filename)
+
+	fd, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	md5hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(fd, md5hash), r)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	newPath := filepath.Join(folderPath, "cur", fmt.Sprintf("%s,FMD5=%x%s", filename, md5hash.Sum(nil), info))
+	err = os.Rename(tmpPath, newPath)
+	if err != nil {
+		// Discard the file, so that the message isn't stored twice
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	return newPath, nil
+}
@@ -0,0 +1,58 @@
+package source
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreMaildirMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mr-source-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	folderPath := filepath.Join(dir, "INBOX")
+	message := "Subject: test\r\n\r\nHello\r\n"
+	paths := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		path, err := StoreMaildirMessage(folderPath, strings.NewReader(message), ",U=12", ":2,S")
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[path] = true
+
+		if filepath.Dir(path) != filepath.Join(folderPath, "cur") {
+			t.Errorf("expected file in cur, got %s", path)
+		}
+		suffix := fmt.Sprintf(",U=12,FMD5=%x:2,S", md5.Sum([]byte(message)))
+		if !strings.HasSuffix(path, suffix) {
+			t.Errorf("expected filename ending with %s, got %s", suffix, filepath.Base(path))
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != message {
+			t.Errorf("unexpected contents %q", data)
+		}
+	}
+	if len(paths) != 2 {
+		t.Errorf("expected unique filenames, got %v", paths)
+	}
+
+	for _, sub := range []string{"tmp", "new"} {
+		files, err := ioutil.ReadDir(filepath.Join(folderPath, sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Errorf("expected %s to be empty, found %d files", sub, len(files))
+		}
+	}
+}
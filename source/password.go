@@ -0,0 +1,65 @@
+package source
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// PasswordCommand runs a shell command which prints a password, and returns the first line of its output
+func PasswordCommand(command string) (string, error) {
+	password, err := runCommand("sh", "-c", command)
+	if err != nil {
+		return "", fmt.Errorf("password command failed: %s", err)
+	}
+	return password, nil
+}
+
+// PasswordFile reads a password from the first line of a file.
+// Files ending with .gpg or .asc are decrypted with gpg, other files must
+// not be readable by anyone but the owner.
+func PasswordFile(path string) (string, error) {
+	ext := filepath.Ext(path)
+	if ext == ".gpg" || ext == ".asc" {
+		password, err := runCommand("gpg", "--quiet", "--batch", "--decrypt", path)
+		if err != nil {
+			return "", fmt.Errorf("gpg failed: %s", err)
+		}
+		return password, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("password file %s is accessible by other users, permissions should be 0600", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return firstLine(data), nil
+}
+
+// runCommand runs a command, and returns the first line of its output
+func runCommand(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return firstLine(out), nil
+}
+
+func firstLine(data []byte) string {
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	return strings.TrimRight(line, "\r")
+}
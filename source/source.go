@@ -0,0 +1,151 @@
+// Package source defines the interface implemented by mail sources, such as IMAP servers,
+// and keeps track of the available types of sources
+package source
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/yzzyx/mr/config"
+	"github.com/yzzyx/mr/notmuch"
+)
+
+// ErrLocked is returned when creating a source if another process is synchronizing the same account
+var ErrLocked = errors.New("mailbox is already being synchronized by another process")
+
+// MailSource synchronizes messages between a mail source and the local maildir
+type MailSource interface {
+	// Connect opens a connection for a synchronization pass, which is closed by Disconnect
+	Connect() error
+	Disconnect()
+
+	// ListFolders returns the folders that should be synchronized
+	ListFolders() ([]string, error)
+	// FetchNew downloads new messages from a folder, and adds them to the index
+	FetchNew(folder string) error
+	// PushChanges synchronizes changes made locally and on the server, after new messages have
+	// been fetched from all folders
+	PushChanges(folder string) error
+
+	// SetOutput sets the destination of progress information
+	SetOutput(w io.Writer)
+	// Close saves the synchronization state, and stops all background work
+	Close() error
+}
+
+// Watcher is implemented by sources which can keep synchronizing in the background
+type Watcher interface {
+	// Watching returns true if watching is enabled in the configuration
+	Watching() bool
+	// Watch starts synchronizing in the background. A value is sent on notify when messages have arrived
+	Watch(notify chan<- struct{})
+	// RequestSync asks the source to synchronize local changes as soon as possible
+	RequestSync()
+}
+
+// Mover is implemented by sources where messages can be moved between folders
+type Mover interface {
+	// Move moves messages to another folder. It returns the ids of the messages which are stored
+	// in this source, which may have been moved even if an error is returned.
+	Move(messageIDs []string, folder string) ([]string, error)
+}
+
+// BodyFetcher is implemented by sources where only the headers of some messages are downloaded.
+// Such messages are tagged with tagnames.Partial.
+type BodyFetcher interface {
+	// FetchBody downloads the full message, and returns the path of the updated file.
+	// An empty path is returned if the message isn't stored in this source.
+	FetchBody(messageID string) (string, error)
+}
+
+// Factory creates a source from the configuration of an account.
+// Messages are stored in the directory 'path', which is inside the notmuch database.
+type Factory func(db *notmuch.Database, path string, account *config.Account) (MailSource, error)
+
+var factories = make(map[string]Factory)
+
+// Register makes a type of source available. It's called from the init function of the package
+// implementing the source.
+func Register(sourceType string, factory Factory) {
+	if _, ok := factories[sourceType]; ok {
+		panic("source: type " + sourceType + " registered twice")
+	}
+	factories[sourceType] = factory
+}
+
+// New creates a source for an account, based on its type
+func New(db *notmuch.Database, path string, account *config.Account) (MailSource, error) {
+	factory, ok := factories[account.Type]
+	if !ok {
+		types := make([]string, 0, len(factories))
+		for t := range factories {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return nil, fmt.Errorf("unknown account type %s (available: %s)", account.Type, strings.Join(types, ", "))
+	}
+	return factory(db, path, account)
+}
+
+// SyncError is returned by Sync if some folders could not be synchronized
+type SyncError struct {
+	Failures map[string]error // Errors by folder
+}
+
+func (e *SyncError) Error() string {
+	folders := make([]string, 0, len(e.Failures))
+	for folder := range e.Failures {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+
+	lines := []string{fmt.Sprintf("could not synchronize %d folder(s):", len(folders))}
+	for _, folder := range folders {
+		lines = append(lines, fmt.Sprintf("  %s: %s", folder, e.Failures[folder]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Sync performs a full synchronization pass of a source.
+// A folder that fails doesn't stop the others from being synchronized, and all failures
+// are returned in a *SyncError.
+func Sync(s MailSource) error {
+	err := s.Connect()
+	if err != nil {
+		return err
+	}
+	defer s.Disconnect()
+
+	folders, err := s.ListFolders()
+	if err != nil {
+		return err
+	}
+
+	failures := make(map[string]error)
+	var fetched []string
+	for _, folder := range folders {
+		err = s.FetchNew(folder)
+		if err != nil {
+			failures[folder] = err
+			continue
+		}
+		fetched = append(fetched, folder)
+	}
+
+	// Changes are pushed once all folders have been checked,
+	// so that messages which have been moved on the server are found in their new location
+	for _, folder := range fetched {
+		err = s.PushChanges(folder)
+		if err != nil {
+			failures[folder] = err
+		}
+	}
+
+	if len(failures) > 0 {
+		return &SyncError{Failures: failures}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LoadState reads a JSON state file into v.
+// It returns false if the file doesn't exist, in which case v is left unchanged.
+func LoadState(path string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return false, fmt.Errorf("cannot read %s: %s", path, err)
+	}
+	return true, nil
+}
+
+// CheckStateVersion returns an error if a state file was written by a version
+// newer than the supported one
+func CheckStateVersion(path string, version, supported int) error {
+	if version > supported {
+		return fmt.Errorf("%s was written by a newer version (%d)", path, version)
+	}
+	return nil
+}
+
+// SaveState writes v to a JSON state file, which is replaced atomically
+func SaveState(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
+
+// WriteFileAtomic replaces the contents of a file, so that it's never left half-written
+// if we crash. The data is written to a temporary file which is synced and renamed into
+// place, with 0600 permissions, and the rename itself is synced as well.
+func WriteFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	fd, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	_ = dir.Sync()
+	return nil
+}
+
+// Checkpoint saves the synchronization state while synchronizing, so that work isn't lost
+// if we crash. Errors are only reported on out, since the state is saved again later.
+func Checkpoint(out io.Writer, save func() error) {
+	err := save()
+	if err != nil {
+		fmt.Fprintf(out, "could not save synchronization state: %s\n", err)
+	}
+}
@@ -0,0 +1,66 @@
+package source
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mr-source-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type state struct {
+		Version int
+		Seen    map[string]bool
+	}
+	path := filepath.Join(dir, ".state")
+
+	s := state{Version: 1}
+	found, err := LoadState(path, &s)
+	if err != nil || found {
+		t.Fatalf("expected missing state file, got %v, %v", found, err)
+	}
+	if s.Version != 1 {
+		t.Errorf("state changed when the file is missing: %+v", s)
+	}
+
+	err = SaveState(path, state{Version: 2, Seen: map[string]bool{"a": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected permissions 0600, got %o", perm)
+	}
+
+	var loaded state
+	found, err = LoadState(path, &loaded)
+	if err != nil || !found {
+		t.Fatalf("expected state file, got %v, %v", found, err)
+	}
+	if loaded.Version != 2 || !loaded.Seen["a"] {
+		t.Errorf("unexpected state %+v", loaded)
+	}
+	if CheckStateVersion(path, loaded.Version, 1) == nil {
+		t.Errorf("expected error for state written by a newer version")
+	}
+
+	err = ioutil.WriteFile(path, []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadState(path, &loaded); err == nil {
+		t.Errorf("expected error for invalid state file")
+	}
+}
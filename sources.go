@@ -0,0 +1,9 @@
+package main
+
+// Available types of accounts. Each package registers its type of source when it's imported.
+import (
+	_ "github.com/yzzyx/mr/imap"
+	_ "github.com/yzzyx/mr/jmap"
+	_ "github.com/yzzyx/mr/maildir"
+	_ "github.com/yzzyx/mr/pop3"
+)
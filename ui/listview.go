@@ -24,6 +24,11 @@ func NewListView(query string) (*ListView, error) {
 	return view, nil
 }
 
+// Refresh reruns the query, in order to show changes made to the database
+func (v *ListView) Refresh() {
+	v.query = models.NewQuery(v.search)
+}
+
 // GetLine returns the contents of a specific line from a query
 func (v *ListView) GetLine(lineNumber int) (string, error) {
 	t := v.query.GetLine(lineNumber)
@@ -127,6 +132,31 @@ func (v *ListView) editTags(ui *UI, lineNumber int) error {
 	})
 }
 
+// moveThread moves all messages in a thread to another folder. Since this talks to the servers,
+// it runs in the background, and the result is shown in the status line.
+func (v *ListView) moveThread(ui *UI, lineNumber int) error {
+	thread := v.query.GetLine(lineNumber)
+	return v.editor(ui, "", func(ok bool, folder string) {
+		folder = strings.TrimSpace(folder)
+		if !ok || folder == "" {
+			return
+		}
+
+		ui.status = fmt.Sprintf("moving %d message(s) to %s...", len(thread.Messages), folder)
+		go func() {
+			err := thread.Move(folder)
+			if err != nil {
+				ui.SetStatus("could not move messages to %s: %s", folder, err)
+			} else {
+				ui.SetStatus("moved %d message(s) to %s", len(thread.Messages), folder)
+			}
+			ui.gui.Update(func(g *gocui.Gui) error {
+				return ui.Refresh()
+			})
+		}()
+	})
+}
+
 func (v *ListView) showSearch(ui *UI) error {
 	return v.editor(ui, "", func(ok bool, search string) {
 		if !ok {
@@ -150,7 +180,7 @@ func (v *ListView) HandleKey(ui *UI, key interface{}, mod gocui.Modifier, lineNu
 			return nil
 		}
 
-		content, err := NewThreadView(thread)
+		content, err := NewThreadView(ui, thread)
 		if err != nil {
 			return err
 		}
@@ -166,6 +196,8 @@ func (v *ListView) HandleKey(ui *UI, key interface{}, mod gocui.Modifier, lineNu
 		//v.lines[lineNumber].tagged = !v.lines[lineNumber].tagged
 		case 't': // tag message
 			return v.editTags(ui, lineNumber)
+		case 'm': // move message to another folder
+			return v.moveThread(ui, lineNumber)
 		case '/': // search for messages
 			return v.showSearch(ui)
 		}
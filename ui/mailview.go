@@ -8,6 +8,7 @@ import (
 	"github.com/jaytaylor/html2text"
 	"github.com/jhillyerd/enmime"
 	"github.com/jroimartin/gocui"
+	"github.com/yzzyx/mr/models"
 )
 
 // MailView displays an email message
@@ -16,11 +17,13 @@ type MailView struct {
 	envelope *enmime.Envelope
 }
 
-// NewMailView creates a new MailView, with the contents from 'filename'
-func NewMailView(filename string) (*MailView, error) {
+// NewMailView creates a new MailView, with the contents of a message.
+// If the message has been stored more than once, the best copy is shown.
+func NewMailView(m models.Message) (*MailView, error) {
 	v := &MailView{}
 	v.lines = []string{}
 
+	filename := m.BestFilename()
 	f, err := os.Open(filename)
 	if err != nil {
 		v.lines = []string{
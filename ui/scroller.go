@@ -10,6 +10,11 @@ type Content interface {
 	HandleKey(ui *UI, key interface{}, mod gocui.Modifier, lineNumber int) error
 }
 
+// Refresher is implemented by contents which can be reloaded, e.g. when new mail arrives
+type Refresher interface {
+	Refresh()
+}
+
 // Scroller defines a scrollable scroller
 type Scroller struct {
 	contents     Content
@@ -37,6 +42,27 @@ func (v *Scroller) GetLabel() (string, error) {
 	return v.contents.GetLabel()
 }
 
+// Refresh reloads the contents, if supported, and makes sure that the selected line is still valid
+func (v *Scroller) Refresh() error {
+	r, ok := v.contents.(Refresher)
+	if !ok {
+		return nil
+	}
+	r.Refresh()
+
+	maxLines, err := v.contents.GetMaxLines()
+	if err != nil {
+		return err
+	}
+	if v.selectedLine >= maxLines {
+		v.selectedLine = maxLines - 1
+	}
+	if v.selectedLine < 0 {
+		v.selectedLine = 0
+	}
+	return v.UpdateHeight(v.height)
+}
+
 // GetSelectedLine returns the currently selected line
 func (v *Scroller) GetSelectedLine() int {
 	return v.selectedLine
@@ -124,7 +150,6 @@ func (v *Scroller) UpdateLinePos(dy int) error {
 		// we're moving down
 		maxlines, err := v.contents.GetMaxLines()
 		if err != nil {
-			panic(err)
 			return err
 		}
 		maxlines-- // maxlines is calculated as number of lines, but we want a 0-indexed entry
@@ -24,37 +24,23 @@ type ThreadView struct {
 	thread   models.Thread
 }
 
-// NewThreadView creates a new view for displaying a specific thread
-func NewThreadView(thread models.Thread) (*ThreadView, error) {
+// NewThreadView creates a new view for displaying a specific thread.
+// Messages where only the headers have been downloaded are shown with their headers,
+// and the rest of the message is downloaded in the background.
+func NewThreadView(ui *UI, thread models.Thread) (*ThreadView, error) {
 	v := &ThreadView{}
-	v.messages = make([]threadMessageInfo, 0, len(v.messages))
+	v.messages = make([]threadMessageInfo, 0, len(thread.Messages))
 	v.thread = thread
 
-	linenumber := 0
-	for _, m := range thread.Messages {
-
-		f, err := os.Open(m.Filename)
-		if err != nil {
-			return v, err
-		}
-
-		env, err := enmime.ReadEnvelope(f)
+	var partial []int
+	for k, m := range thread.Messages {
+		env, lines, err := readMessage(m)
 		if err != nil {
 			return v, err
 		}
-
-		lines := []string{}
-		for _, hdr := range []string{"Subject", "From", "To", "Cc", "Bcc", "Date"} {
-			line := env.GetHeader(hdr)
-			if line == "" {
-				continue
-			}
-			lines = append(lines, " │ "+hdr+": "+line)
-		}
-
-		content := strings.Split(env.Text, "\n")
-		for k := range content {
-			lines = append(lines, " │ "+strings.ReplaceAll(content[k], "\r", ""))
+		if m.Partial {
+			lines = append(lines, " │ (downloading message...)")
+			partial = append(partial, k)
 		}
 		v.messages = append(v.messages, threadMessageInfo{
 			Message:   m,
@@ -63,12 +49,73 @@ func NewThreadView(thread models.Thread) (*ThreadView, error) {
 			envelope:  env,
 			lines:     lines,
 		})
-		linenumber++
+	}
 
+	if len(partial) > 0 {
+		go v.fetchBodies(ui, partial)
 	}
 	return v, nil
 }
 
+// fetchBodies downloads the messages with the specified indexes, and updates the view when each one is done.
+// If the download fails, the headers are still shown.
+func (v *ThreadView) fetchBodies(ui *UI, indexes []int) {
+	for _, k := range indexes {
+		m := v.thread.Messages[k]
+		fetchErr := m.FetchBody()
+
+		k := k
+		ui.gui.Update(func(g *gocui.Gui) error {
+			env, lines, err := readMessage(m)
+			if err != nil {
+				env, lines = v.messages[k].envelope, v.messages[k].lines[:len(v.messages[k].lines)-1]
+				fetchErr = err
+			}
+			if fetchErr != nil {
+				lines = append(lines, " │ (cannot download message: "+fetchErr.Error()+")")
+			}
+
+			info := &v.messages[k]
+			info.Message = m
+			info.envelope = env
+			info.lines = lines
+			if info.expanded {
+				info.lineCount = len(lines) + 1
+			}
+			return nil
+		})
+	}
+}
+
+// readMessage reads the headers and the text of a message
+func readMessage(m models.Message) (*enmime.Envelope, []string, error) {
+	f, err := os.Open(m.BestFilename())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	env, err := enmime.ReadEnvelope(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := []string{}
+	for _, hdr := range []string{"Subject", "From", "To", "Cc", "Bcc", "Date"} {
+		line := env.GetHeader(hdr)
+		if line == "" {
+			continue
+		}
+		lines = append(lines, " │ "+hdr+": "+line)
+	}
+
+	content := strings.Split(env.Text, "\n")
+	for k := range content {
+		lines = append(lines, " │ "+strings.ReplaceAll(content[k], "\r", ""))
+	}
+	return env, lines, nil
+}
+
 // GetLine returns the contents of a specific line in the thread view
 func (v *ThreadView) GetLine(lineNumber int) (string, error) {
 	count := 0
@@ -11,6 +11,7 @@ type UI struct {
 	currentView *Scroller
 	views       []*Scroller
 	gui         *gocui.Gui
+	status      string // Shown on the last line of the screen, if set
 }
 
 // RenderHeader writes the contents of the current header to screen
@@ -123,6 +124,35 @@ func (ui *UI) RenderList(g *gocui.Gui) error {
 	return nil
 }
 
+// RenderStatus writes the status message to the last line of the screen
+func (ui *UI) RenderStatus(g *gocui.Gui) error {
+	if ui.status == "" {
+		err := g.DeleteView("status")
+		if err != nil && err != gocui.ErrUnknownView {
+			return err
+		}
+		return nil
+	}
+
+	maxX, maxY := g.Size()
+	v, err := g.SetView("status", -1, maxY-2, maxX, maxY)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	_, err = g.SetViewOnTop(v.Name())
+	if err != nil {
+		return err
+	}
+
+	v.Frame = false
+	v.Wrap = false
+	v.BgColor = gocui.ColorWhite
+	v.FgColor = gocui.ColorBlack
+	v.Clear()
+	_, err = fmt.Fprintf(v, " %-[1]*.[1]*[2]s", maxX, ui.status)
+	return err
+}
+
 // Layout is responsible for updating the complete contents of the screen
 func (ui *UI) Layout(g *gocui.Gui) error {
 	err := ui.RenderHeader(g)
@@ -131,7 +161,21 @@ func (ui *UI) Layout(g *gocui.Gui) error {
 	}
 
 	err = ui.RenderList(g)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return ui.RenderStatus(g)
+}
+
+// SetStatus shows a message on the last line of the screen, until it's replaced by another one.
+// It may be called from any goroutine.
+func (ui *UI) SetStatus(format string, args ...interface{}) {
+	status := fmt.Sprintf(format, args...)
+	ui.gui.Update(func(g *gocui.Gui) error {
+		ui.status = status
+		return nil
+	})
 }
 
 // AddView adds an additional view/tab to the ui
@@ -140,6 +184,16 @@ func (ui *UI) AddView(v *Scroller) {
 	ui.currentView = v
 }
 
+// Refresh reloads the contents of all views
+func (ui *UI) Refresh() error {
+	for _, v := range ui.views {
+		if err := v.Refresh(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NextView displays the next view from the list of available views
 func (ui *UI) NextView() {
 	var idx int
@@ -214,8 +268,9 @@ func (ui *UI) editView(g *gocui.Gui, v *gocui.View) error {
 	return err
 }
 
-// Setup initializes the UI
-func Setup() error {
+// Setup initializes the UI.
+// All views are reloaded each time a value is received on 'refresh', which may be nil.
+func Setup(refresh <-chan struct{}) error {
 	g, err := gocui.NewGui(gocui.Output256)
 	if err != nil {
 		return err
@@ -238,6 +293,16 @@ func Setup() error {
 		return err
 	}
 
+	if refresh != nil {
+		go func() {
+			for range refresh {
+				g.Update(func(g *gocui.Gui) error {
+					return ui.Refresh()
+				})
+			}
+		}()
+	}
+
 	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
 		return err
 	}